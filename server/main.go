@@ -1,19 +1,17 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
-	"sort"
 	"strings"
 	"time"
 
 	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
 	serverv3 "github.com/envoyproxy/go-control-plane/pkg/server/v3"
-	ytsdk "go.ytsaurus.tech/yt/go/yt"
 
 	"github.com/ytsaurus/ytsaurus-task-proxy/pkg"
 )
@@ -21,6 +19,14 @@ import (
 func main() {
 	ctx := context.Background()
 
+	if len(os.Args) > 1 && pkg.IsCommand(os.Args[1]) {
+		if err := pkg.RunCommand(ctx, os.Args[1], os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	var args struct {
 		namespace              string
 		ytTokenPath            string
@@ -29,96 +35,302 @@ func main() {
 		discoveryPeriodSeconds uint
 		authEnabled            bool
 		authCookieName         string
+		grpcWebAllowedOrigins  string
+		envoyAdminURL          string
+		routeTimeout           time.Duration
+		routeIdleTimeout       time.Duration
+		retryOn                string
+		numRetries             uint
+		stickyCookieTTL        time.Duration
+		stalenessThreshold     time.Duration
+		logLevel               string
+		otlpEndpoint           string
+		traceSamplingPercent   float64
+		historyTTL             time.Duration
+		clustersConfigPath     string
+		ytProxy                string
+		ytUseTLS               bool
+		ytCAPath               string
+		ytProxyDiscovery       bool
+		ytProxyRole            string
+		ytUserProxy            string
+		tlsCertDirs            string
+		additionalBaseDomains  string
+		httpRedirect           bool
+		acmeChallengeEndpoint  string
+		hstsMaxAge             time.Duration
+		hstsIncludeSubdomains  bool
+		clientCertMode         string
+		clientCAPath           string
+		clientCertUsersPath    string
 	}
 	flag.StringVar(&args.namespace, "namespace", "", "k8s namespace")
 	flag.StringVar(&args.ytTokenPath, "yt-token-path", "", "YT token path")
+	flag.StringVar(&args.ytProxy, "yt-proxy", "", "YT HTTP proxy [scheme://]host[:port], HTTP proxies balancer in 'namespace' if empty")
+	flag.BoolVar(&args.ytUseTLS, "yt-use-tls", false, "use TLS for YT proxy without https scheme")
+	flag.StringVar(&args.ytCAPath, "yt-ca-path", "", "PEM bundle with CA certificates of YT proxies, in addition to system ones")
+	flag.BoolVar(&args.ytProxyDiscovery, "yt-proxy-discovery", false, "discover YT proxies behind 'yt-proxy' address and send requests to them")
+	flag.StringVar(&args.ytProxyRole, "yt-proxy-role", "", "role of discovered YT proxies, default role if empty")
+	flag.StringVar(&args.ytUserProxy, "yt-user-proxy", "", "YT HTTP proxy for requests with user credentials, 'yt-proxy' if empty")
 	flag.StringVar(&args.baseDomain, "base-domain", "", "base domain for jobs")
+	flag.StringVar(
+		&args.additionalBaseDomains,
+		"additional-base-domains",
+		"",
+		"comma-separated base domains task services are available under too, 'base-domain' is used in services table",
+	)
 	flag.StringVar(&args.dirPath, "dir-path", "", "Task proxy directory path")
 	flag.UintVar(&args.discoveryPeriodSeconds, "discovery-period-seconds", 60, "services discovery period in seconds")
 	flag.BoolVar(&args.authEnabled, "auth-enabled", true, "operation auth enabled")
 	flag.StringVar(&args.authCookieName, "auth-cookie-name", "", "auth cookie name")
+	flag.StringVar(
+		&args.grpcWebAllowedOrigins,
+		"grpc-web-allowed-origins",
+		"",
+		"comma-separated origins allowed to call gRPC-Web services with credentials, any origin without credentials if empty",
+	)
+	flag.StringVar(
+		&args.tlsCertDirs,
+		"tls-cert-dirs",
+		"",
+		"comma-separated [domain=]directory list with tls.crt and tls.key served to Envoy for subdomains of domain, "+
+			"or for any server name without domain; tasks aren't served until any of them appears, listener is plaintext if empty",
+	)
+	flag.BoolVar(
+		&args.httpRedirect,
+		"http-redirect",
+		false,
+		"plaintext listener serving ACME challenges and redirecting to HTTPS once certificates are served",
+	)
+	flag.StringVar(
+		&args.acmeChallengeEndpoint,
+		"acme-challenge-endpoint",
+		"",
+		"host:port of ACME HTTP-01 solver for challenge paths of 'http-redirect' listener, challenges are redirected too if empty",
+	)
+	flag.DurationVar(&args.hstsMaxAge, "hsts-max-age", 0, "max-age of Strict-Transport-Security header of HTTPS responses, 0 disables header")
+	flag.BoolVar(&args.hstsIncludeSubdomains, "hsts-include-subdomains", false, "add includeSubDomains to Strict-Transport-Security header")
+	flag.StringVar(
+		&args.clientCertMode,
+		"client-cert-mode",
+		"",
+		"client certificates on TLS listener: 'accept' makes them optional, 'require' rejects clients without them; disabled if empty",
+	)
+	flag.StringVar(&args.clientCAPath, "client-ca-path", "", "PEM bundle with CA certificates of clients, required by 'client-cert-mode'")
+	flag.StringVar(
+		&args.clientCertUsersPath,
+		"client-cert-users",
+		"",
+		"YAML config with 'users' mapping client certificate subject or SAN to YT user, certificates don't identify users if empty",
+	)
+	flag.StringVar(&args.envoyAdminURL, "envoy-admin-url", "http://127.0.0.1:9901", "Envoy admin interface URL")
+	flag.DurationVar(&args.routeTimeout, "route-timeout", 15*time.Second, "default route timeout, 0 disables timeout")
+	flag.DurationVar(&args.routeIdleTimeout, "route-idle-timeout", 0, "default route idle timeout, 0 keeps Envoy default")
+	flag.StringVar(&args.retryOn, "retry-on", "", "default Envoy retry conditions, e.g. 'connect-failure,reset', empty disables retries")
+	flag.UintVar(&args.numRetries, "num-retries", 1, "default number of retries")
+	flag.DurationVar(&args.stickyCookieTTL, "sticky-cookie-ttl", time.Hour, "default TTL of session affinity cookie, 0 makes session cookie")
+	flag.DurationVar(
+		&args.stalenessThreshold,
+		"readiness-staleness-threshold",
+		10*time.Minute,
+		"server is not ready when discovery of every cluster is failing longer than this threshold",
+	)
+	flag.StringVar(&args.logLevel, "log-level", "info", "log level: debug, info, warn or error")
+	flag.StringVar(&args.otlpEndpoint, "otlp-endpoint", "", "OTLP gRPC collector host:port for tracing, tracing is disabled if empty")
+	flag.Float64Var(&args.traceSamplingPercent, "trace-sampling-percent", 100, "percent of traced requests and discovery cycles")
+	flag.DurationVar(&args.historyTTL, "history-ttl", 30*24*time.Hour, "retention of task events in history table, 0 disables history")
+	flag.StringVar(
+		&args.clustersConfigPath,
+		"clusters-config",
+		"",
+		"YAML config with clusters served by one proxy, 'namespace', 'dir-path' and 'yt-*' arguments are ignored if set",
+	)
 	flag.Parse()
 
-	if args.namespace == "" {
-		log.Fatal("'namespace' argument is required")
-	}
-	if args.ytTokenPath == "" {
-		log.Fatal("'yt-token-path' argument is required")
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(args.logLevel)); err != nil {
+		log.Fatalf("invalid 'log-level' argument: %v", err)
 	}
+	logger := pkg.CreateLogger(logLevel)
+
 	if args.baseDomain == "" {
-		log.Fatal("'base-domain' argument is required")
-	}
-	if args.dirPath == "" {
-		log.Fatal("'dir-path' argument is required")
+		logger.Fatal("'base-domain' argument is required")
 	}
 	if args.discoveryPeriodSeconds < 1 || args.discoveryPeriodSeconds > 24*60*60 {
-		log.Fatal("'discovery-period-seconds' argument must be positive and not greater than 24 hours")
+		logger.Fatal("'discovery-period-seconds' argument must be positive and not greater than 24 hours")
 	}
 
-	ytTokenBytes, err := os.ReadFile(args.ytTokenPath)
-	if err != nil {
-		log.Fatalf("failed to read YT token: %v", err)
+	var clusters []pkg.ClusterConfig
+	if args.clustersConfigPath != "" {
+		var err error
+		if clusters, err = pkg.LoadClustersConfig(args.clustersConfigPath); err != nil {
+			logger.Fatal("failed to load clusters config", "error", err)
+		}
+	} else {
+		ytProxy := args.ytProxy
+		if ytProxy == "" {
+			if args.namespace == "" {
+				logger.Fatal("'namespace' or 'yt-proxy' argument is required")
+			}
+			ytProxy = fmt.Sprintf("http-proxies-lb.%s.svc.cluster.local", args.namespace)
+		}
+		if args.ytTokenPath == "" {
+			logger.Fatal("'yt-token-path' argument is required")
+		}
+		if args.dirPath == "" {
+			logger.Fatal("'dir-path' argument is required")
+		}
+		// single cluster, its task domains are not namespaced by cluster name
+		cluster := pkg.ClusterConfig{
+			YTConnection: pkg.YTConnection{
+				Proxy:          ytProxy,
+				UseTLS:         args.ytUseTLS,
+				CAPath:         args.ytCAPath,
+				ProxyDiscovery: args.ytProxyDiscovery,
+				ProxyRole:      args.ytProxyRole,
+			},
+			TokenPath: args.ytTokenPath,
+			DirPath:   args.dirPath,
+		}
+		if args.ytUserProxy != "" {
+			// user requests go through the same kind of proxies, so connection settings are shared
+			cluster.UserConnection = cluster.YTConnection
+			cluster.UserConnection.Proxy = args.ytUserProxy
+		}
+		clusters = []pkg.ClusterConfig{cluster}
 	}
-	ytToken := strings.TrimSpace(string(ytTokenBytes))
 
-	ytProxy := fmt.Sprintf("http-proxies-lb.%s.svc.cluster.local", args.namespace)
-	ytClient, err := pkg.CreateYTClient(ytProxy, &ytsdk.TokenCredentials{Token: ytToken})
+	if args.otlpEndpoint != "" {
+		// the endpoint is Envoy cluster too, invalid one would fail every snapshot
+		if err := pkg.ValidateEndpoint(args.otlpEndpoint); err != nil {
+			logger.Fatal("invalid 'otlp-endpoint' argument", "error", err)
+		}
+		// the percent is Envoy random sampling too, which rejects listener with out of range one
+		if !(args.traceSamplingPercent >= 0 && args.traceSamplingPercent <= 100) {
+			logger.Fatal("'trace-sampling-percent' argument must be between 0 and 100")
+		}
+		shutdownTracing, err := pkg.InitTracing(ctx, args.otlpEndpoint, args.traceSamplingPercent)
+		if err != nil {
+			logger.Fatal("failed to init tracing", "error", err)
+		}
+		defer func() { _ = shutdownTracing(ctx) }()
+	}
+
+	cache := cachev3.NewSnapshotCache(true, cachev3.IDHash{}, logger.CacheLogger())
+
+	clientCertMode, err := pkg.ParseClientCertificateMode(args.clientCertMode)
 	if err != nil {
-		log.Fatalf("failed to create YT client: %v", err)
+		logger.Fatal("invalid 'client-cert-mode' argument", "error", err)
+	}
+	var clientCA []byte
+	if clientCertMode != pkg.ClientCertificateNone {
+		if args.clientCAPath == "" {
+			logger.Fatal("'client-ca-path' argument is required by 'client-cert-mode'")
+		}
+		if clientCA, err = os.ReadFile(args.clientCAPath); err != nil {
+			logger.Fatal("failed to read client CA", "error", err)
+		}
 	}
 
-	tls := false
-	if _, err := os.Stat(pkg.TLSCrtPath); err == nil {
-		if _, err := os.Stat(pkg.TLSKeyPath); err == nil {
-			tls = true
+	authServer := pkg.CreateAuthServer(logger, args.authCookieName)
+	if args.clientCertUsersPath != "" {
+		mapping, err := pkg.LoadClientCertificateMapping(args.clientCertUsersPath)
+		if err != nil {
+			logger.Fatal("failed to load client certificate users", "error", err)
 		}
+		authServer.SetClientCertificateMapping(mapping)
 	}
 
-	logger := pkg.SimpleLogger{}
+	var grpcWebAllowedOrigins []string
+	for _, origin := range strings.Split(args.grpcWebAllowedOrigins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			grpcWebAllowedOrigins = append(grpcWebAllowedOrigins, origin)
+		}
+	}
 
-	cache := cachev3.NewSnapshotCache(true, cachev3.IDHash{}, logger)
+	var additionalBaseDomains []string
+	for _, domain := range strings.Split(args.additionalBaseDomains, ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			additionalBaseDomains = append(additionalBaseDomains, domain)
+		}
+	}
 
-	taskDiscovery := pkg.CreateTaskDiscovery(args.baseDomain, args.dirPath, ytClient, &logger)
+	if args.acmeChallengeEndpoint != "" {
+		// the endpoint is Envoy cluster of redirect listener, invalid one would fail every snapshot
+		if err := pkg.ValidateEndpoint(args.acmeChallengeEndpoint); err != nil {
+			logger.Fatal("invalid 'acme-challenge-endpoint' argument", "error", err)
+		}
+	}
 
-	authServer := pkg.CreateAuthServer(ytClient, ytProxy, &logger, args.authCookieName)
+	certificateDirs := pkg.ParseCertificateDirs(args.tlsCertDirs)
 
-	taskUpdater := pkg.CreateTaskUpdater(args.baseDomain, tls, args.authEnabled, authServer, taskDiscovery, cache)
+	snapshotConfig := pkg.SnapshotConfig{
+		BaseDomain:            args.baseDomain,
+		AdditionalBaseDomains: additionalBaseDomains,
+		TLSRequired:           len(certificateDirs) > 0,
+		HTTPRedirect:          args.httpRedirect,
+		ACMEChallengeEndpoint: args.acmeChallengeEndpoint,
+		HSTSMaxAge:            args.hstsMaxAge,
+		HSTSIncludeSubdomains: args.hstsIncludeSubdomains,
+		ClientCertificateMode: clientCertMode,
+		ClientCA:              clientCA,
+		AuthEnabled:           args.authEnabled,
+		GRPCWebAllowedOrigins: grpcWebAllowedOrigins,
+		RouteTimeout:          args.routeTimeout,
+		RouteIdleTimeout:      args.routeIdleTimeout,
+		RetryOn:               args.retryOn,
+		NumRetries:            uint32(args.numRetries),
+		StickyCookieTTL:       args.stickyCookieTTL,
+		OTLPEndpoint:          args.otlpEndpoint,
+		TraceSamplingPercent:  args.traceSamplingPercent,
+	}
 
-	go func() {
-		var version string
-		for {
-			tasks, err := taskDiscovery.Discovery(ctx)
-			if err != nil {
-				logger.Errorf("failed to discover tasks: %v", err)
-				continue // preserve old version of table, err is probably transient
-			}
+	readiness := pkg.CreateReadiness(args.stalenessThreshold)
 
-			sort.Sort(tasks)
-			hashToTask := make(map[string]pkg.Task)
-			var buf bytes.Buffer
-			for _, task := range tasks {
-				buf.Write([]byte(task.IDWithHostPort()))
-				hashToTask[pkg.Hash([]byte(task.ID()))] = task
-			}
+	taskUpdater := pkg.CreateTaskUpdater(snapshotConfig, authServer, cache, readiness, logger)
 
-			newVersion := pkg.Hash(buf.Bytes())
-			if version == newVersion {
-				logger.Debugf("no changes in discovered tasks")
-			} else {
-				logger.Infof("%d tasks discovered:\n%s", len(tasks), tasks)
-				version = newVersion
-
-				err = taskUpdater.Update(ctx, hashToTask, version)
-				if err != nil {
-					logger.Errorf("failed to update tasks: %v", err)
-					version = "" // drop version so we will retry update on next iteration
-				}
-			}
+	for _, cluster := range clusters {
+		clusterLogger := logger
+		if cluster.Name != "" {
+			clusterLogger = logger.With("cluster", cluster.Name)
+		}
 
-			time.Sleep(time.Duration(args.discoveryPeriodSeconds) * time.Second)
+		ytToken, err := pkg.LoadYTTokenFile(cluster.TokenPath, clusterLogger)
+		if err != nil {
+			clusterLogger.Fatal("failed to read YT token", "error", err)
+		}
+		go ytToken.Watch(ctx)
+
+		ytClient, err := pkg.CreateYTClient(cluster.YTConnection, ytToken)
+		if err != nil {
+			clusterLogger.Fatal("failed to create YT client", "error", err)
+		}
+
+		if err := authServer.AddCluster(cluster.Name, ytClient, cluster.GetUserConnection()); err != nil {
+			clusterLogger.Fatal("failed to create YT config for user requests", "error", err)
+		}
+		taskUpdater.AddCluster(
+			pkg.CreateTaskDiscovery(cluster.Name, args.baseDomain, cluster.DirPath, args.historyTTL, ytClient, clusterLogger),
+			// leader discovers tasks and writes services table, followers apply tasks from the table
+			pkg.CreateLeaderElection(cluster.Name, cluster.DirPath, ytClient, clusterLogger),
+		)
+	}
+
+	// certificates are loaded before tasks, so the first snapshot already has TLS listener
+	certificateWatcher := pkg.CreateCertificateWatcher(certificateDirs, taskUpdater, logger)
+	certificateWatcher.Reload(ctx)
+	go certificateWatcher.Run(ctx)
+
+	adminServer := pkg.CreateAdminServer(args.envoyAdminURL, readiness, taskUpdater, logger)
+	go func() {
+		if err := adminServer.Serve(); err != nil {
+			logger.Fatal("failed to serve admin HTTP API", "error", err)
 		}
 	}()
-	if err := pkg.ServeGRPC(serverv3.NewServer(ctx, cache, nil), authServer); err != nil {
-		log.Fatalf("failed to serve gRPC: %v", err)
+
+	go taskUpdater.Run(ctx, time.Duration(args.discoveryPeriodSeconds)*time.Second)
+
+	if err := pkg.ServeGRPC(serverv3.NewServer(ctx, cache, nil), authServer, readiness, logger); err != nil {
+		logger.Fatal("failed to serve gRPC", "error", err)
 	}
 }
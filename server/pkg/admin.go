@@ -0,0 +1,261 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type adminServer struct {
+	// API for operators, reachable only from pod, e.g. with kubectl port-forward
+	mux *http.ServeMux
+	// probes and metrics reachable by kubelet and Prometheus
+	probeMux      *http.ServeMux
+	envoyAdminURL string
+	httpClient    *http.Client
+	readiness     *readiness
+	taskUpdater   *taskUpdater
+	logger        *Logger
+}
+
+func CreateAdminServer(
+	envoyAdminURL string,
+	readiness *readiness,
+	taskUpdater *taskUpdater,
+	logger *Logger,
+) *adminServer {
+	s := &adminServer{
+		mux:           http.NewServeMux(),
+		probeMux:      http.NewServeMux(),
+		envoyAdminURL: envoyAdminURL,
+		httpClient:    &http.Client{Timeout: 5 * time.Second},
+		readiness:     readiness,
+		taskUpdater:   taskUpdater,
+		logger:        logger,
+	}
+	s.probeMux.HandleFunc("GET /healthz", s.handleProbe(readiness.alive))
+	s.probeMux.HandleFunc("GET /readyz", s.handleProbe(readiness.ready))
+	s.probeMux.Handle("GET /metrics", promhttp.Handler())
+	s.mux.HandleFunc("GET /api/v1/tasks", s.handleListTasks)
+	s.mux.HandleFunc("GET /api/v1/tasks/{hash}", s.handleGetTask)
+	s.mux.HandleFunc("GET /api/v1/operations/{operation_id}/tasks", s.handleListOperationTasks)
+	s.mux.HandleFunc("GET /api/v1/snapshot", s.handleGetSnapshot)
+	s.mux.HandleFunc("GET /api/v1/errors", s.handleListErrors)
+	s.mux.HandleFunc("GET /api/v1/health", s.handleHealth)
+	s.mux.HandleFunc("GET /api/v1/log-level", s.handleGetLogLevel)
+	s.mux.HandleFunc("PUT /api/v1/log-level", s.handleSetLogLevel)
+	return s
+}
+
+// Serves probes on all interfaces and admin API on loopback, as the API exposes tasks and changes log level;
+// returns error of the first server failed
+func (s *adminServer) Serve() error {
+	s.logger.Info("probes and metrics start listening", "port", adminPort)
+	s.logger.Info("admin HTTP API starts listening", "address", adminAPIAddress)
+
+	errs := make(chan error, 2)
+	go func() {
+		errs <- http.ListenAndServe(fmt.Sprintf(":%d", adminPort), s.probeMux)
+	}()
+	go func() {
+		errs <- http.ListenAndServe(adminAPIAddress, s.mux)
+	}()
+	return <-errs
+}
+
+func (s *adminServer) handleProbe(check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok\n"))
+	}
+}
+
+// Tasks sorted by ID, optionally filtered by operation
+func (s *adminServer) listTasks(operationID string) []TaskInfo {
+	hashToTask, _ := s.taskUpdater.getTasks()
+
+	var tasks TaskList
+	taskToHash := make(map[string]string)
+	for hash, task := range hashToTask {
+		if operationID != "" && task.operationID != operationID {
+			continue
+		}
+		tasks = append(tasks, task)
+		taskToHash[task.ID()] = hash
+	}
+	sort.Sort(tasks)
+
+	taskInfos := make([]TaskInfo, 0, len(tasks))
+	for _, task := range tasks {
+		taskInfos = append(taskInfos, makeTaskInfo(taskToHash[task.ID()], task, s.taskUpdater.config.BaseDomain))
+	}
+	return taskInfos
+}
+
+func (s *adminServer) handleListTasks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.listTasks(r.URL.Query().Get("operation_id")), s.logger)
+}
+
+func (s *adminServer) handleGetTask(w http.ResponseWriter, r *http.Request) {
+	hash := r.PathValue("hash")
+	hashToTask, _ := s.taskUpdater.getTasks()
+	task, ok := hashToTask[hash]
+	if !ok {
+		http.Error(w, fmt.Sprintf("no task with hash %q", hash), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, makeTaskInfo(hash, task, s.taskUpdater.config.BaseDomain), s.logger)
+}
+
+func (s *adminServer) handleListOperationTasks(w http.ResponseWriter, r *http.Request) {
+	operationID := r.PathValue("operation_id")
+	tasks := s.listTasks(operationID)
+	if len(tasks) == 0 {
+		http.Error(w, fmt.Sprintf("no tasks for operation %q", operationID), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, tasks, s.logger)
+}
+
+func (s *adminServer) handleGetSnapshot(w http.ResponseWriter, r *http.Request) {
+	info, err := s.taskUpdater.getSnapshotInfo()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, info, s.logger)
+}
+
+func (s *adminServer) handleListErrors(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.taskUpdater.getOperationErrors(), s.logger)
+}
+
+type LogLevel struct {
+	Level string `json:"level"`
+}
+
+func (s *adminServer) handleGetLogLevel(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, LogLevel{Level: s.logger.Level().String()}, s.logger)
+}
+
+// Changes log level in runtime, e.g. PUT /api/v1/log-level?level=debug
+func (s *adminServer) handleSetLogLevel(w http.ResponseWriter, r *http.Request) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(r.URL.Query().Get("level"))); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.logger.SetLevel(level)
+	s.logger.Info("log level changed", "level", level.String())
+	writeJSON(w, LogLevel{Level: level.String()}, s.logger)
+}
+
+type EndpointHealth struct {
+	Hostname                string `json:"hostname"`
+	Address                 string `json:"address"`
+	Healthy                 bool   `json:"healthy"`
+	FailedActiveHealthCheck bool   `json:"failed_active_health_check"`
+	FailedOutlierCheck      bool   `json:"failed_outlier_check"`
+}
+
+type ClusterHealth struct {
+	Cluster   string           `json:"cluster"`
+	Endpoints []EndpointHealth `json:"endpoints"`
+}
+
+// Health of task endpoints as Envoy sees it, from active health checks and outlier detection
+func (s *adminServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	health, err := s.getClustersHealth(r.Context())
+	if err != nil {
+		s.logger.Error("failed to get clusters health from Envoy admin", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, health, s.logger)
+}
+
+// Subset of Envoy admin /clusters?format=json response
+type envoyClusters struct {
+	ClusterStatuses []struct {
+		Name         string `json:"name"`
+		AddedViaAPI  bool   `json:"added_via_api"`
+		HostStatuses []struct {
+			Hostname string `json:"hostname"`
+			Address  struct {
+				SocketAddress struct {
+					Address   string `json:"address"`
+					PortValue uint32 `json:"port_value"`
+				} `json:"socket_address"`
+			} `json:"address"`
+			HealthStatus struct {
+				EdsHealthStatus         string `json:"eds_health_status"`
+				FailedActiveHealthCheck bool   `json:"failed_active_health_check"`
+				FailedOutlierCheck      bool   `json:"failed_outlier_check"`
+			} `json:"health_status"`
+		} `json:"host_statuses"`
+	} `json:"cluster_statuses"`
+}
+
+func (s *adminServer) getClustersHealth(ctx context.Context) ([]ClusterHealth, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.envoyAdminURL+"/clusters?format=json", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected Envoy admin response status %q", resp.Status)
+	}
+
+	var clusters envoyClusters
+	if err := json.NewDecoder(resp.Body).Decode(&clusters); err != nil {
+		return nil, err
+	}
+
+	health := make([]ClusterHealth, 0)
+	for _, cluster := range clusters.ClusterStatuses {
+		// static clusters (xDS) and ext_authz cluster are not task clusters
+		if !cluster.AddedViaAPI || cluster.Name == extAuthClusterName {
+			continue
+		}
+		clusterHealth := ClusterHealth{Cluster: cluster.Name, Endpoints: make([]EndpointHealth, 0)}
+		for _, host := range cluster.HostStatuses {
+			status := host.HealthStatus
+			clusterHealth.Endpoints = append(clusterHealth.Endpoints, EndpointHealth{
+				Hostname: host.Hostname,
+				Address: net.JoinHostPort(
+					host.Address.SocketAddress.Address,
+					strconv.Itoa(int(host.Address.SocketAddress.PortValue)),
+				),
+				Healthy:                 status.EdsHealthStatus == "HEALTHY" && !status.FailedActiveHealthCheck && !status.FailedOutlierCheck,
+				FailedActiveHealthCheck: status.FailedActiveHealthCheck,
+				FailedOutlierCheck:      status.FailedOutlierCheck,
+			})
+		}
+		health = append(health, clusterHealth)
+	}
+	return health, nil
+}
+
+func writeJSON(w http.ResponseWriter, v any, logger *Logger) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		logger.Error("failed to write JSON response", "error", err)
+	}
+}
@@ -0,0 +1,210 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const envoyClustersResponse = `{
+  "cluster_statuses": [
+    {
+      "name": "xds_cluster",
+      "host_statuses": [{"address": {"socket_address": {"address": "127.0.0.1", "port_value": 9090}}}]
+    },
+    {
+      "name": "extAuthz",
+      "added_via_api": true,
+      "host_statuses": [{"address": {"socket_address": {"address": "127.0.0.1", "port_value": 9090}}}]
+    },
+    {
+      "name": "op1-jupyter-lab",
+      "added_via_api": true,
+      "host_statuses": [
+        {
+          "hostname": "node1",
+          "address": {"socket_address": {"address": "10.0.0.1", "port_value": 8888}},
+          "health_status": {"eds_health_status": "HEALTHY"}
+        },
+        {
+          "hostname": "node2",
+          "address": {"socket_address": {"address": "10.0.0.2", "port_value": 8888}},
+          "health_status": {"eds_health_status": "HEALTHY", "failed_active_health_check": true}
+        }
+      ]
+    }
+  ]
+}`
+
+func createTestAdminServer(envoyAdminURL string) *adminServer {
+	logger := createTestLogger()
+	readiness := CreateReadiness(time.Minute)
+	discovery := &taskDiscovery{baseDomain: testSnapshotConfig.BaseDomain, logger: logger}
+	taskUpdater := CreateTaskUpdater(
+		testSnapshotConfig,
+		nil,
+		cachev3.NewSnapshotCache(false, cachev3.IDHash{}, logger.CacheLogger()),
+		readiness,
+		logger,
+	)
+	taskUpdater.AddCluster(discovery, nil)
+	return CreateAdminServer(envoyAdminURL, readiness, taskUpdater, logger)
+}
+
+func TestTasksAPI(t *testing.T) {
+	s := createTestAdminServer("")
+	s.taskUpdater.hashToTask = map[string]Task{
+		"00000002": {
+			operationID: "op2",
+			taskName:    "driver",
+			service:     "ui",
+			protocol:    HTTP,
+			jobs:        []HostPort{{host: "node2", port: 4040}},
+		},
+		"00000001": {
+			operationID: "op1",
+			taskName:    "jupyter",
+			service:     "lab",
+			protocol:    HTTP,
+			jobs:        []HostPort{{host: "node1", port: 8888}, {host: "node3", port: 8888}},
+		},
+	}
+
+	testCases := []struct {
+		name       string
+		path       string
+		statusCode int
+		expected   any
+	}{
+		{
+			name:       "all tasks",
+			path:       "/api/v1/tasks",
+			statusCode: http.StatusOK,
+			expected:   []any{"00000001", "00000002"},
+		},
+		{
+			name:       "tasks filtered by operation",
+			path:       "/api/v1/tasks?operation_id=op2",
+			statusCode: http.StatusOK,
+			expected:   []any{"00000002"},
+		},
+		{
+			name:       "operation tasks",
+			path:       "/api/v1/operations/op1/tasks",
+			statusCode: http.StatusOK,
+			expected:   []any{"00000001"},
+		},
+		{
+			name:       "unknown operation",
+			path:       "/api/v1/operations/op3/tasks",
+			statusCode: http.StatusNotFound,
+		},
+		{
+			name:       "unknown task",
+			path:       "/api/v1/tasks/00000003",
+			statusCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			s.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+			require.Equal(t, tc.statusCode, rec.Code)
+			if tc.expected == nil {
+				return
+			}
+
+			var tasks []TaskInfo
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &tasks))
+			hashes := make([]any, 0, len(tasks))
+			for _, task := range tasks {
+				hashes = append(hashes, task.Hash)
+			}
+			assert.Equal(t, tc.expected, hashes)
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	s.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/tasks/00000001", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var task TaskInfo
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &task))
+	assert.Equal(t, TaskInfo{
+		Hash:        "00000001",
+		Domain:      "00000001.example.net",
+		OperationID: "op1",
+		TaskName:    "jupyter",
+		Service:     "lab",
+		Protocol:    "http",
+		Jobs:        []string{"node1:8888", "node3:8888"},
+	}, task)
+}
+
+func TestSnapshotAPI(t *testing.T) {
+	s := createTestAdminServer("")
+
+	rec := httptest.NewRecorder()
+	s.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/snapshot", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	snapshot, err := makeSnapshot(map[string]Task{}, "42", testSnapshotConfig)
+	require.NoError(t, err)
+	require.NoError(t, s.taskUpdater.cache.SetSnapshot(context.Background(), NodeID, snapshot))
+
+	rec = httptest.NewRecorder()
+	s.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/snapshot", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var info SnapshotInfo
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &info))
+	assert.Equal(t, "42", info.Version)
+}
+
+func TestProbesSeparatedFromAPI(t *testing.T) {
+	s := createTestAdminServer("")
+
+	for _, tc := range []struct {
+		mux          *http.ServeMux
+		method       string
+		path         string
+		expectedCode int
+	}{
+		{mux: s.probeMux, method: http.MethodGet, path: "/metrics", expectedCode: http.StatusOK},
+		{mux: s.probeMux, method: http.MethodGet, path: "/api/v1/tasks", expectedCode: http.StatusNotFound},
+		{mux: s.probeMux, method: http.MethodPut, path: "/api/v1/log-level?level=debug", expectedCode: http.StatusNotFound},
+		{mux: s.mux, method: http.MethodGet, path: "/api/v1/tasks", expectedCode: http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		tc.mux.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, nil))
+		assert.Equal(t, tc.expectedCode, rec.Code, tc.path)
+	}
+}
+
+func TestGetClustersHealth(t *testing.T) {
+	envoyAdmin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/clusters", r.URL.Path)
+		assert.Equal(t, "json", r.URL.Query().Get("format"))
+		_, _ = w.Write([]byte(envoyClustersResponse))
+	}))
+	defer envoyAdmin.Close()
+
+	s := createTestAdminServer(envoyAdmin.URL)
+	health, err := s.getClustersHealth(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []ClusterHealth{
+		{
+			Cluster: "op1-jupyter-lab",
+			Endpoints: []EndpointHealth{
+				{Hostname: "node1", Address: "10.0.0.1:8888", Healthy: true},
+				{Hostname: "node2", Address: "10.0.0.2:8888", FailedActiveHealthCheck: true},
+			},
+		},
+	}, health)
+}
@@ -5,12 +5,16 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 
 	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
 	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.ytsaurus.tech/yt/go/guid"
 	"go.ytsaurus.tech/yt/go/yt"
 	ytsdk "go.ytsaurus.tech/yt/go/yt"
+	ythttpsdk "go.ytsaurus.tech/yt/go/yt/ythttp"
 	"google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc/codes"
 )
@@ -18,29 +22,85 @@ import (
 type authServer struct {
 	authv3.UnimplementedAuthorizationServer
 
-	mx             sync.RWMutex
-	hashToTasks    map[string]Task
-	yt             ytsdk.Client
-	ytProxy        string
-	logger         *SimpleLogger
+	mx          sync.RWMutex
+	hashToTasks map[string]Task
+	// clusters by name, registered before serving
+	clusters       map[string]authCluster
+	logger         *Logger
 	authCookieName string
+	// users of client certificates, certificates are ignored if nil
+	clientCertificateMapping *ClientCertificateMapping
 }
 
-func CreateAuthServer(yt ytsdk.Client, ytProxy string, logger *SimpleLogger, authCookieName string) *authServer {
+// Cluster where permissions of its operations are checked
+type authCluster struct {
+	yt ytsdk.Client
+	// client identifying users, credentials of each check are passed with context
+	userYT ytsdk.Client
+}
+
+func CreateAuthServer(logger *Logger, authCookieName string) *authServer {
 	return &authServer{
 		hashToTasks:    make(map[string]Task),
 		mx:             sync.RWMutex{},
-		yt:             yt,
-		ytProxy:        ytProxy,
+		clusters:       make(map[string]authCluster),
 		logger:         logger,
 		authCookieName: authCookieName,
 	}
 }
 
+// Registers cluster of tasks discovered with the same cluster name; users are identified through
+// separate connection, as proxies for user requests can differ from ones of control plane client
+func (s *authServer) AddCluster(name string, yt ytsdk.Client, userConnection YTConnection) error {
+	userYTConfig, err := userConnection.ytConfig()
+	if err != nil {
+		return err
+	}
+	// client is shared by checks, so connections to proxies are reused
+	userYT, err := ythttpsdk.NewClient(&userYTConfig)
+	if err != nil {
+		return err
+	}
+	s.clusters[name] = authCluster{yt: yt, userYT: userYT}
+	return nil
+}
+
+// Identifies users by client certificates forwarded by Envoy, before credentials in headers
+func (s *authServer) SetClientCertificateMapping(mapping *ClientCertificateMapping) {
+	s.clientCertificateMapping = mapping
+}
+
+// Reasons of ext_authz decisions for metrics
+const (
+	authReasonNoHost             = "no_host"
+	authReasonUnknownTask        = "unknown_task"
+	authReasonStatics            = "statics"
+	authReasonNoCredentials      = "no_credentials"
+	authReasonUnknownUser        = "unknown_user"
+	authReasonInvalidOperationID = "invalid_operation_id"
+	authReasonPermission         = "permission"
+	authReasonError              = "error"
+)
+
 func (s *authServer) Check(ctx context.Context, req *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	ctx = extractTraceContext(ctx, req.GetAttributes().GetRequest().GetHttp().GetHeaders())
+	ctx, span := tracer.Start(ctx, "authServer.Check", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
+	start := time.Now()
+	allowed, reason := s.check(ctx, req)
+	observeAuthDecision(allowed, reason, start)
+	span.SetAttributes(attribute.Bool("auth.allowed", allowed), attribute.String("auth.reason", reason))
+
+	if !allowed {
+		return deniedResponse, nil
+	}
+	return okResponse, nil
+}
+
+func (s *authServer) check(ctx context.Context, req *authv3.CheckRequest) (bool, string) {
 	httpAttrs := req.GetAttributes().GetRequest().GetHttp()
 	path := httpAttrs.GetPath()
-	headers := httpAttrs.GetHeaders()
 
 	var hash string
 	if routerHeaderValue, ok := httpAttrs.Headers[routerHeaderName]; ok {
@@ -48,36 +108,53 @@ func (s *authServer) Check(ctx context.Context, req *authv3.CheckRequest) (*auth
 	} else if host := httpAttrs.Host; host != "" {
 		hash = strings.Split(host, ".")[0]
 	} else {
-		s.logger.Warnf("authority (host) or %s headers are missing in request", routerHeaderName)
-		return deniedResponse, nil
+		s.logger.Warn("authority (host) or router headers are missing in request", "header", routerHeaderName)
+		return false, authReasonNoHost
 	}
 
-	s.logger.Debugf("checking auth for hash %q, path %q", hash, path)
+	logger := s.logger.With("hash", hash, "path", path)
+	logger.Debug("checking auth")
 
 	task, ok := s.getHashToTasks()[hash]
 	if !ok {
-		s.logger.Warnf("no entry for hash %q in tasks registry", hash)
-		return deniedResponse, nil
+		logger.Warn("no entry for hash in tasks registry")
+		return false, authReasonUnknownTask
 	}
 
 	// skip auth for UI services for statics; currently it is the case for SPYT UI
 	if task.service == "ui" && strings.HasPrefix(path, "/static") {
-		s.logger.Debugf("skip auth for 'ui' service for statics on path %s", path)
-		return okResponse, nil
+		logger.Debug("skip auth for 'ui' service for statics")
+		return true, authReasonStatics
 	}
 
-	s.logger.Debugf("auth for hash %q, path %q, task %v", hash, path, task)
+	logger = logger.With("operation_id", task.operationID, "task", task.taskName, "service", task.service)
+	if task.cluster != "" {
+		logger = logger.With("cluster", task.cluster)
+	}
+	logger.Debug("auth for task")
 
-	allowed, err := s.checkOperationPermission(ctx, task.operationID, headers)
+	cluster, ok := s.clusters[task.cluster]
+	if !ok {
+		logger.Error("no YT client for task cluster")
+		return false, authReasonError
+	}
+	user, reason, err := s.identifyUser(ctx, logger, cluster, req)
 	if err != nil {
-		s.logger.Errorf("error while checking operation permission: %v", err)
-		return deniedResponse, nil
+		logger.Error("error while identifying user", "error", err)
+		return false, authReasonError
 	}
+	if user == "" {
+		return false, reason
+	}
+	logger = logger.With("user", user)
+	logger.Debug("auth user identified")
 
-	if !allowed {
-		return deniedResponse, nil
+	allowed, reason, err := s.checkOperationPermission(ctx, logger, cluster, task.operationID, user)
+	if err != nil {
+		logger.Error("error while checking operation permission", "error", err)
+		return false, authReasonError
 	}
-	return okResponse, nil
+	return allowed, reason
 }
 
 func (s *authServer) SetHashToTasks(hashToTasks map[string]Task) {
@@ -94,56 +171,95 @@ func (s *authServer) getHashToTasks() map[string]Task {
 	return s.hashToTasks
 }
 
-// TODO: temporary implementation, use YT Go SDK instead
-func (s *authServer) checkOperationPermission(ctx context.Context, operationID string, headers map[string]string) (bool, error) {
-	userCredentials := s.getYTCredentialsFromHeaders(headers)
+// User of mapped client certificate, otherwise the one whose credentials are in headers;
+// empty user comes with reason of denial
+func (s *authServer) identifyUser(
+	ctx context.Context,
+	logger *Logger,
+	cluster authCluster,
+	req *authv3.CheckRequest,
+) (string, string, error) {
+	if user := s.getClientCertificateUser(logger, req.GetAttributes().GetSource().GetCertificate()); user != "" {
+		logger.Debug("user authorization is client certificate")
+		return user, "", nil
+	}
+
+	userCredentials := s.getYTCredentialsFromHeaders(logger, req.GetAttributes().GetRequest().GetHttp().GetHeaders())
 	if userCredentials == nil {
-		return false, nil
+		return "", authReasonNoCredentials, nil
 	}
 
-	userYT, err := CreateYTClient(s.ytProxy, userCredentials)
+	var userResp *ytsdk.WhoAmIResult
+	err := doYTRequest(ctx, "whoami", func(ctx context.Context) (err error) {
+		userResp, err = cluster.userYT.WhoAmI(ytsdk.WithCredentials(ctx, userCredentials), nil)
+		return err
+	})
 	if err != nil {
-		return false, err
+		return "", "", err
 	}
 
-	userResp, err := userYT.WhoAmI(ctx, nil)
-	if err != nil {
-		return false, err
+	if userResp.Login == "" {
+		logger.Warn("user not identified by provided credentials")
+		return "", authReasonUnknownUser, nil
 	}
+	return userResp.Login, "", nil
+}
 
-	user := userResp.Login
+// YT user of peer certificate forwarded by Envoy, empty if there is no certificate or it's not mapped
+func (s *authServer) getClientCertificateUser(logger *Logger, encodedCertificate string) string {
+	if s.clientCertificateMapping == nil || encodedCertificate == "" {
+		return ""
+	}
+	cert, err := parsePeerCertificate(encodedCertificate)
+	if err != nil {
+		logger.Warn("failed to parse client certificate", "error", err)
+		return ""
+	}
+	user := s.clientCertificateMapping.user(cert)
 	if user == "" {
-		s.logger.Warnf("user not identified by provided credentials")
-		return false, nil
+		logger.Warn("client certificate is not mapped to YT user", "subject", cert.Subject.String())
 	}
-	s.logger.Debugf("auth user is %q", user)
+	return user
+}
 
+// TODO: temporary implementation, use YT Go SDK instead
+func (s *authServer) checkOperationPermission(
+	ctx context.Context,
+	logger *Logger,
+	cluster authCluster,
+	operationID string,
+	user string,
+) (bool, string, error) {
 	operationIDg, err := guid.ParseString(operationID)
 	if err != nil {
-		s.logger.Warnf("invalid operation ID %s", operationID)
-		return false, nil
+		logger.Warn("invalid operation ID")
+		return false, authReasonInvalidOperationID, nil
 	}
 
-	resp, err := s.yt.CheckOperationPermission(
-		ctx,
-		yt.OperationID(operationIDg),
-		user,
-		yt.PermissionRead,
-		nil,
-	)
+	var resp *ytsdk.CheckOperationPermissionResponse
+	err = doYTRequest(ctx, "check_operation_permission", func(ctx context.Context) (err error) {
+		resp, err = cluster.yt.CheckOperationPermission(
+			ctx,
+			yt.OperationID(operationIDg),
+			user,
+			yt.PermissionRead,
+			nil,
+		)
+		return err
+	})
 	if err != nil {
-		return false, err
+		return false, "", err
 	}
 
-	s.logger.Debugf("check operation permission result is %q for user %q and operation %q", resp.Action, user, operationID)
-	return resp.Action == "allow", nil
+	logger.Debug("check operation permission result", "action", resp.Action)
+	return resp.Action == "allow", authReasonPermission, nil
 }
 
-func (s *authServer) getYTCredentialsFromHeaders(headers map[string]string) ytsdk.Credentials {
+func (s *authServer) getYTCredentialsFromHeaders(logger *Logger, headers map[string]string) ytsdk.Credentials {
 	if auth, ok := headers["authorization"]; ok {
 		parts := strings.Split(auth, " ")
 		if len(parts) != 2 {
-			s.logger.Warnf("invalid authorization header value")
+			logger.Warn("invalid authorization header value")
 			return nil
 		}
 		name := strings.ToLower(parts[0])
@@ -151,13 +267,13 @@ func (s *authServer) getYTCredentialsFromHeaders(headers map[string]string) ytsd
 
 		switch name {
 		case "oauth":
-			s.logger.Debugf("user authorization is OAuth token")
+			logger.Debug("user authorization is OAuth token")
 			return &ytsdk.TokenCredentials{Token: value}
 		case "bearer":
-			s.logger.Debugf("user authorization is Bearer token")
+			logger.Debug("user authorization is Bearer token")
 			return &ytsdk.BearerCredentials{Token: value}
 		default:
-			s.logger.Warnf("unknown authorization header name %s", name)
+			logger.Warn("unknown authorization header name", "name", name)
 			return nil
 		}
 	}
@@ -165,18 +281,18 @@ func (s *authServer) getYTCredentialsFromHeaders(headers map[string]string) ytsd
 	if cookiesStr, ok := headers["cookie"]; ok {
 		cookies, err := http.ParseCookie(cookiesStr)
 		if err != nil {
-			s.logger.Warnf("failed to parse cookies: %v", err)
+			logger.Warn("failed to parse cookies", "error", err)
 			return nil
 		}
 		for _, cookie := range cookies {
 			if cookie.Name == s.authCookieName {
-				s.logger.Debugf("user authorization is %q cookie", s.authCookieName)
+				logger.Debug("user authorization is cookie", "cookie", s.authCookieName)
 				return &ytsdk.CookieCredentials{Cookie: cookie}
 			}
 		}
 	}
 
-	s.logger.Warnf("no supported authorization method in headers: %q cookie, bearer/oauth token", s.authCookieName)
+	logger.Warn("no supported authorization method in headers: cookie, bearer/oauth token", "cookie", s.authCookieName)
 	return nil
 }
 
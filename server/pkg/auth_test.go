@@ -0,0 +1,89 @@
+package pkg
+
+import (
+	"context"
+	"testing"
+
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+func makeCheckRequest(host, path string, headers map[string]string) *authv3.CheckRequest {
+	return &authv3.CheckRequest{
+		Attributes: &authv3.AttributeContext{
+			Request: &authv3.AttributeContext_Request{
+				Http: &authv3.AttributeContext_HttpRequest{
+					Host:    host,
+					Path:    path,
+					Headers: headers,
+				},
+			},
+		},
+	}
+}
+
+func TestCheckWithoutYT(t *testing.T) {
+	s := CreateAuthServer(createTestLogger(), "YTCypressCookie")
+	require.NoError(t, s.AddCluster("", nil, YTConnection{Proxy: "localhost"}))
+	s.SetHashToTasks(map[string]Task{
+		"00000001": {operationID: "op1", taskName: "driver", service: "ui"},
+		"00000003": {cluster: "unknown", operationID: "op3", taskName: "driver", service: "ui"},
+	})
+
+	for _, tt := range []struct {
+		name           string
+		request        *authv3.CheckRequest
+		expectedCode   codes.Code
+		expectedResult string
+		expectedReason string
+	}{
+		{
+			name:           "no host",
+			request:        makeCheckRequest("", "/", nil),
+			expectedCode:   codes.PermissionDenied,
+			expectedResult: "denied",
+			expectedReason: authReasonNoHost,
+		},
+		{
+			name:           "unknown task",
+			request:        makeCheckRequest("00000002.example.net", "/", nil),
+			expectedCode:   codes.PermissionDenied,
+			expectedResult: "denied",
+			expectedReason: authReasonUnknownTask,
+		},
+		{
+			name:           "UI statics",
+			request:        makeCheckRequest("00000001.example.net", "/static/app.js", nil),
+			expectedCode:   codes.OK,
+			expectedResult: "allowed",
+			expectedReason: authReasonStatics,
+		},
+		{
+			name:           "no credentials",
+			request:        makeCheckRequest("", "/", map[string]string{routerHeaderName: "00000001"}),
+			expectedCode:   codes.PermissionDenied,
+			expectedResult: "denied",
+			expectedReason: authReasonNoCredentials,
+		},
+		{
+			name:           "task of unknown cluster",
+			request:        makeCheckRequest("00000003.unknown.example.net", "/", nil),
+			expectedCode:   codes.PermissionDenied,
+			expectedResult: "denied",
+			expectedReason: authReasonError,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			decisions := authDecisions.WithLabelValues(tt.expectedResult, tt.expectedReason)
+			before := testutil.ToFloat64(decisions)
+
+			resp, err := s.Check(context.Background(), tt.request)
+			require.NoError(t, err)
+			assert.Equal(t, int32(tt.expectedCode), resp.Status.Code)
+			assert.Equal(t, before+1, testutil.ToFloat64(decisions))
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+)
+
+const (
+	// file names in Kubernetes TLS secret
+	tlsCertFileName = "tls.crt"
+	tlsKeyFileName  = "tls.key"
+
+	// cert-manager renews certificates long before expiration, so checking files twice a minute is enough
+	certificatesReloadPeriod = 30 * time.Second
+)
+
+// Directory with tls.crt and tls.key, its certificate is served for subdomains of Domain,
+// or for any server name if Domain is empty
+type CertificateDir struct {
+	Domain string
+	Path   string
+}
+
+// Parses comma-separated list of [domain=]path
+func ParseCertificateDirs(value string) []CertificateDir {
+	var dirs []CertificateDir
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		var dir CertificateDir
+		if domain, path, ok := strings.Cut(item, "="); ok {
+			dir = CertificateDir{Domain: domain, Path: path}
+		} else {
+			dir = CertificateDir{Path: item}
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+// Certificate secret with domain whose subdomains it's served for
+type serverCertificate struct {
+	domain string
+	secret *tlsv3.Secret
+}
+
+// Server certificates from directories with tls.crt and tls.key, served to Envoy over SDS;
+// files are re-read periodically, so renewed or added certificates are served without restarts
+type certificateWatcher struct {
+	dirs        []CertificateDir
+	taskUpdater *taskUpdater
+	// hash of files content last applied
+	version string
+	logger  *Logger
+}
+
+func CreateCertificateWatcher(dirs []CertificateDir, taskUpdater *taskUpdater, logger *Logger) *certificateWatcher {
+	return &certificateWatcher{
+		dirs:        dirs,
+		taskUpdater: taskUpdater,
+		logger:      logger,
+	}
+}
+
+// Re-reads certificates until ctx is done
+func (w *certificateWatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(certificatesReloadPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.Reload(ctx)
+		}
+	}
+}
+
+// Applies certificates if files changed; previous ones are kept if any pair is invalid,
+// e.g. when certificate is already updated but key is not yet
+func (w *certificateWatcher) Reload(ctx context.Context) {
+	certificates, version, err := loadCertificates(w.dirs)
+	if err != nil {
+		w.logger.Error("failed to load TLS certificates, previous ones are served", "error", err)
+		certificateReloads.WithLabelValues(outcome(err)).Inc()
+		return
+	}
+	if version == w.version {
+		return
+	}
+
+	if err := w.taskUpdater.SetCertificates(ctx, certificates, version); err != nil {
+		w.logger.Error("failed to apply TLS certificates", "error", err)
+		certificateReloads.WithLabelValues(outcome(err)).Inc()
+		return
+	}
+	w.version = version
+	certificateReloads.WithLabelValues(outcomeSuccess).Inc()
+	w.logger.Info("TLS certificates applied", "count", len(certificates))
+}
+
+// Certificates of directories with both files, and hash of their content
+func loadCertificates(dirs []CertificateDir) ([]serverCertificate, string, error) {
+	var certificates []serverCertificate
+	var content bytes.Buffer
+	for i, dir := range dirs {
+		certChain, err := os.ReadFile(filepath.Join(dir.Path, tlsCertFileName))
+		if errors.Is(err, fs.ErrNotExist) {
+			// secret is not issued yet
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		privateKey, err := os.ReadFile(filepath.Join(dir.Path, tlsKeyFileName))
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := tls.X509KeyPair(certChain, privateKey); err != nil {
+			return nil, "", fmt.Errorf("invalid certificate in %s: %w", dir.Path, err)
+		}
+		certificates = append(certificates, serverCertificate{
+			domain: dir.Domain,
+			secret: makeCertificateSecret(fmt.Sprintf("server_cert_%d", i), certChain, privateKey),
+		})
+		content.WriteString(dir.Domain)
+		content.Write(certChain)
+		content.Write(privateKey)
+	}
+	if len(certificates) == 0 {
+		return nil, "", nil
+	}
+	return certificates, Hash(content.Bytes()), nil
+}
+
+// Secret with certificate files of Envoy container
+func makeFileCertificateSecret(name, dir string) *tlsv3.Secret {
+	return &tlsv3.Secret{
+		Name: name,
+		Type: &tlsv3.Secret_TlsCertificate{
+			TlsCertificate: &tlsv3.TlsCertificate{
+				CertificateChain: &corev3.DataSource{
+					Specifier: &corev3.DataSource_Filename{Filename: filepath.Join(dir, tlsCertFileName)},
+				},
+				PrivateKey: &corev3.DataSource{
+					Specifier: &corev3.DataSource_Filename{Filename: filepath.Join(dir, tlsKeyFileName)},
+				},
+			},
+		},
+	}
+}
+
+// Secret with certificate content, Envoy doesn't need access to files
+func makeCertificateSecret(name string, certChain, privateKey []byte) *tlsv3.Secret {
+	return &tlsv3.Secret{
+		Name: name,
+		Type: &tlsv3.Secret_TlsCertificate{
+			TlsCertificate: &tlsv3.TlsCertificate{
+				CertificateChain: &corev3.DataSource{
+					Specifier: &corev3.DataSource_InlineBytes{InlineBytes: certChain},
+				},
+				PrivateKey: &corev3.DataSource{
+					Specifier: &corev3.DataSource_InlineBytes{InlineBytes: privateKey},
+				},
+			},
+		},
+	}
+}
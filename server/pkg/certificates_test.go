@@ -0,0 +1,140 @@
+package pkg
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	listenerv3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	resourcev3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Writes self-signed certificate for domain as Kubernetes TLS secret files
+// Self-signed certificate and its key in PEM
+func generateTestCertificate(t *testing.T, domain string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeTestCertificate(t *testing.T, dir, domain string) {
+	cert, key := generateTestCertificate(t, domain)
+	require.NoError(t, os.MkdirAll(dir, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, tlsCertFileName), cert, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, tlsKeyFileName), key, 0o600))
+}
+
+func TestLoadCertificates(t *testing.T) {
+	dir := t.TempDir()
+	certDir := filepath.Join(dir, "cert")
+	missingDir := filepath.Join(dir, "missing")
+
+	certificates, version, err := loadCertificates([]CertificateDir{{Path: certDir}, {Path: missingDir}})
+	require.NoError(t, err)
+	assert.Empty(t, certificates)
+	assert.Empty(t, version)
+
+	writeTestCertificate(t, certDir, "*.example.net")
+	certificates, version, err = loadCertificates([]CertificateDir{{Path: certDir}, {Path: missingDir}})
+	require.NoError(t, err)
+	require.Len(t, certificates, 1)
+	assert.Equal(t, "server_cert_0", certificates[0].secret.Name)
+	assert.NotEmpty(t, version)
+
+	// renewed certificate has other version
+	writeTestCertificate(t, certDir, "*.example.net")
+	_, renewedVersion, err := loadCertificates([]CertificateDir{{Path: certDir}})
+	require.NoError(t, err)
+	assert.NotEqual(t, version, renewedVersion)
+
+	// certificate is written before key
+	require.NoError(t, os.WriteFile(filepath.Join(certDir, tlsKeyFileName), []byte("partial"), 0o600))
+	_, _, err = loadCertificates([]CertificateDir{{Path: certDir}})
+	assert.Error(t, err)
+}
+
+func TestCertificateWatcher(t *testing.T) {
+	logger := createTestLogger()
+	cache := cachev3.NewSnapshotCache(false, cachev3.IDHash{}, logger.CacheLogger())
+	taskUpdater := CreateTaskUpdater(testSnapshotConfig, CreateAuthServer(logger, ""), cache, CreateReadiness(time.Minute), logger)
+	taskUpdater.AddCluster(CreateTaskDiscovery("", testSnapshotConfig.BaseDomain, "//tmp", 0, nil, logger), nil)
+	require.NoError(t, taskUpdater.Apply(context.Background(), "", map[string]Task{}))
+
+	getTLSContext := func() *tlsv3.DownstreamTlsContext {
+		snapshot, err := cache.GetSnapshot(NodeID)
+		require.NoError(t, err)
+		listener := snapshot.GetResources(resourcev3.ListenerType)["listener_0"].(*listenerv3.Listener)
+		transportSocket := listener.FilterChains[0].TransportSocket
+		if transportSocket == nil {
+			return nil
+		}
+		var tlsContext tlsv3.DownstreamTlsContext
+		require.NoError(t, transportSocket.GetTypedConfig().UnmarshalTo(&tlsContext))
+		return &tlsContext
+	}
+
+	certDir := filepath.Join(t.TempDir(), "cert")
+	watcher := CreateCertificateWatcher([]CertificateDir{{Path: certDir}}, taskUpdater, logger)
+	watcher.Reload(context.Background())
+	assert.Nil(t, getTLSContext())
+	assert.False(t, taskUpdater.tlsEnabled())
+
+	// certificate issued after start turns TLS on
+	writeTestCertificate(t, certDir, "*.example.net")
+	watcher.Reload(context.Background())
+	tlsContext := getTLSContext()
+	require.NotNil(t, tlsContext)
+	sdsConfigs := tlsContext.CommonTlsContext.TlsCertificateSdsSecretConfigs
+	require.Len(t, sdsConfigs, 1)
+	assert.NotNil(t, sdsConfigs[0].SdsConfig.GetAds())
+
+	snapshot, err := cache.GetSnapshot(NodeID)
+	require.NoError(t, err)
+	assert.Contains(t, snapshot.GetResources(resourcev3.SecretType), sdsConfigs[0].Name)
+	version := snapshot.GetVersion(resourcev3.SecretType)
+
+	// renewed certificate is pushed with new snapshot version
+	writeTestCertificate(t, certDir, "*.example.net")
+	watcher.Reload(context.Background())
+	snapshot, err = cache.GetSnapshot(NodeID)
+	require.NoError(t, err)
+	assert.NotEqual(t, version, snapshot.GetVersion(resourcev3.SecretType))
+}
+
+func TestParseCertificateDirs(t *testing.T) {
+	assert.Nil(t, ParseCertificateDirs(""))
+	assert.Equal(t, []CertificateDir{{Path: "/etc/certs"}}, ParseCertificateDirs("/etc/certs"))
+	assert.Equal(
+		t,
+		[]CertificateDir{
+			{Domain: "tasks.cluster-a.example", Path: "/etc/certs/a"},
+			{Domain: "legacy.example", Path: "/etc/certs/legacy"},
+		},
+		ParseCertificateDirs("tasks.cluster-a.example=/etc/certs/a, legacy.example=/etc/certs/legacy"),
+	)
+}
@@ -0,0 +1,317 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	ytsdk "go.ytsaurus.tech/yt/go/yt"
+)
+
+const cliUsage = `Usage: task-proxy <command> [flags]
+
+Commands:
+  list [--operation-id <id>] [--user <user>]     list proxied task services
+  resolve <operation-id> [task] [service]        print domains of operation task services
+  check-access <domain> [--path <path>]          check access of token owner to task service domain
+  render <fixture> [--output <path>]             render Envoy config for YSON/JSON fixture without cluster
+
+Common flags: --proxy (or YT_PROXY), --token (or YT_TOKEN), --token-path, --dir-path, --cluster.
+`
+
+var errAccessDenied = errors.New("access denied")
+
+// Commands of command-line client, anything else is treated as server flags
+func IsCommand(name string) bool {
+	switch name {
+	case "list", "resolve", "check-access", "render", "help":
+		return true
+	}
+	return false
+}
+
+// Runs command-line client command, tasks are read from services table
+func RunCommand(ctx context.Context, name string, args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	var cli cliArgs
+	cli.register(fs)
+
+	var operationID, user, path, output string
+	var renderConfig SnapshotConfig
+	var numRetries uint
+	var tls bool
+	switch name {
+	case "list":
+		fs.StringVar(&operationID, "operation-id", "", "show tasks of operation only")
+		fs.StringVar(&user, "user", "", "show tasks of user running operations only")
+	case "check-access":
+		fs.StringVar(&path, "path", "/", "request path")
+	case "render":
+		fs.StringVar(&output, "output", "", "output path, stdout if empty")
+		fs.BoolVar(&renderConfig.AuthEnabled, "auth-enabled", true, "operation auth enabled")
+		fs.BoolVar(&tls, "tls", false, "TLS listener with server certificate from /etc/certs")
+		fs.DurationVar(&renderConfig.RouteTimeout, "route-timeout", 15*time.Second, "default route timeout")
+		fs.StringVar(&renderConfig.RetryOn, "retry-on", "", "default Envoy retry conditions")
+		fs.UintVar(&numRetries, "num-retries", 1, "default number of retries")
+		fs.DurationVar(&renderConfig.StickyCookieTTL, "sticky-cookie-ttl", time.Hour, "default TTL of session affinity cookie")
+	case "help":
+		_, _ = fmt.Fprint(stdout, cliUsage)
+		return nil
+	}
+
+	positional, err := parseCommandArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	switch name {
+	case "list":
+		if len(positional) != 0 {
+			return fmt.Errorf("unexpected arguments: %v", positional)
+		}
+		return cli.list(ctx, operationID, user, stdout)
+	case "resolve":
+		if len(positional) < 1 || len(positional) > 3 {
+			return errors.New("usage: task-proxy resolve <operation-id> [task] [service]")
+		}
+		return cli.resolve(ctx, positional, stdout)
+	case "check-access":
+		if len(positional) != 1 {
+			return errors.New("usage: task-proxy check-access <domain> [--path <path>]")
+		}
+		return cli.checkAccess(ctx, positional[0], path, stdout)
+	case "render":
+		if len(positional) != 1 {
+			return errors.New("usage: task-proxy render <fixture> [--output <path>]")
+		}
+		renderConfig.BaseDomain = cli.baseDomain
+		renderConfig.NumRetries = uint32(numRetries)
+		if tls {
+			renderConfig.Certificates = []serverCertificate{{secret: makeFileCertificateSecret("server_cert_0", renderCertificateDir)}}
+		}
+		return cli.render(ctx, positional[0], output, renderConfig, stdout)
+	}
+	return fmt.Errorf("unknown command %q\n%s", name, cliUsage)
+}
+
+// Go flag package stops at first positional argument, so flags after positional ones are parsed one by one
+func parseCommandArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+type cliArgs struct {
+	proxy      string
+	token      string
+	tokenPath  string
+	dirPath    string
+	baseDomain string
+	cluster    string
+}
+
+func (c *cliArgs) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.proxy, "proxy", os.Getenv("YT_PROXY"), "YT proxy")
+	fs.StringVar(&c.token, "token", os.Getenv("YT_TOKEN"), "YT token")
+	fs.StringVar(&c.tokenPath, "token-path", "", "YT token path, used if token is not set")
+	fs.StringVar(&c.dirPath, "dir-path", "//sys/task_proxies", "Task proxy directory path")
+	fs.StringVar(&c.baseDomain, "base-domain", "", "base domain for jobs, domains are computed without reading services table if set")
+	fs.StringVar(&c.cluster, "cluster", "", "cluster name of multi-cluster server, part of task domains")
+}
+
+func (c *cliArgs) createYTClient() (ytsdk.Client, error) {
+	if c.proxy == "" {
+		return nil, errors.New("'proxy' argument or YT_PROXY environment variable is required")
+	}
+	token := c.token
+	if token == "" && c.tokenPath != "" {
+		tokenBytes, err := os.ReadFile(c.tokenPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read YT token: %w", err)
+		}
+		token = strings.TrimSpace(string(tokenBytes))
+	}
+	if token == "" {
+		return nil, errors.New("'token' argument or YT_TOKEN environment variable is required")
+	}
+	c.token = token
+	return CreateYTClient(YTConnection{Proxy: c.proxy}, &ytsdk.TokenCredentials{Token: token})
+}
+
+func (c *cliArgs) createTaskDiscovery() (*taskDiscovery, error) {
+	yt, err := c.createYTClient()
+	if err != nil {
+		return nil, err
+	}
+	return CreateTaskDiscovery(c.cluster, c.baseDomain, c.dirPath, 0, yt, createLogger(os.Stderr, slog.LevelWarn)), nil
+}
+
+func (c *cliArgs) list(ctx context.Context, operationID, user string, stdout io.Writer) error {
+	d, err := c.createTaskDiscovery()
+	if err != nil {
+		return err
+	}
+	rows, err := d.load(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read services table: %w", err)
+	}
+
+	var userOperations map[string]bool
+	if user != "" {
+		operations, err := d.listOperations(ctx, user)
+		if err != nil {
+			return fmt.Errorf("failed to list operations of user: %w", err)
+		}
+		userOperations = make(map[string]bool)
+		for _, op := range operations {
+			userOperations[op.ID.String()] = true
+		}
+	}
+
+	filtered := make([]TaskRow, 0, len(rows))
+	for _, row := range filterTaskRows(rows, operationID, "", "") {
+		if userOperations == nil || userOperations[row.OperationID] {
+			filtered = append(filtered, row)
+		}
+	}
+	return writeTaskRows(stdout, filtered)
+}
+
+func (c *cliArgs) resolve(ctx context.Context, positional []string, stdout io.Writer) error {
+	operationID, taskName, service := positional[0], "", ""
+	if len(positional) > 1 {
+		taskName = positional[1]
+	}
+	if len(positional) > 2 {
+		service = positional[2]
+	}
+
+	// domain of fully specified task service doesn't depend on discovery state
+	if service != "" && c.baseDomain != "" {
+		task := Task{cluster: c.cluster, operationID: operationID, taskName: taskName, service: service}
+		_, err := fmt.Fprintln(stdout, task.domain(Hash([]byte(task.ID())), c.baseDomain))
+		return err
+	}
+
+	d, err := c.createTaskDiscovery()
+	if err != nil {
+		return err
+	}
+	rows, err := d.load(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read services table: %w", err)
+	}
+	rows = filterTaskRows(rows, operationID, taskName, service)
+	if len(rows) == 0 {
+		return fmt.Errorf("no task services found for %s", strings.Join(positional, "/"))
+	}
+	return writeTaskRows(stdout, rows)
+}
+
+func (c *cliArgs) checkAccess(ctx context.Context, domain, path string, stdout io.Writer) error {
+	d, err := c.createTaskDiscovery()
+	if err != nil {
+		return err
+	}
+	rows, err := d.load(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read services table: %w", err)
+	}
+	hashToTask := make(map[string]Task)
+	for _, row := range rows {
+		task, err := row.task(c.cluster)
+		if err != nil {
+			return err
+		}
+		hashToTask[row.Hash] = task
+	}
+
+	// the same check as Envoy asks for, on behalf of token owner
+	authServer := CreateAuthServer(d.logger, "")
+	if err := authServer.AddCluster(c.cluster, d.yt, YTConnection{Proxy: c.proxy}); err != nil {
+		return err
+	}
+	authServer.SetHashToTasks(hashToTask)
+	allowed, reason := authServer.check(ctx, &authv3.CheckRequest{
+		Attributes: &authv3.AttributeContext{
+			Request: &authv3.AttributeContext_Request{
+				Http: &authv3.AttributeContext_HttpRequest{
+					Host:    domain,
+					Path:    path,
+					Headers: map[string]string{"authorization": "OAuth " + c.token},
+				},
+			},
+		},
+	})
+	if !allowed {
+		_, _ = fmt.Fprintf(stdout, "denied (%s)\n", reason)
+		return errAccessDenied
+	}
+	_, err = fmt.Fprintf(stdout, "allowed (%s)\n", reason)
+	return err
+}
+
+func (c *cliArgs) render(ctx context.Context, fixturePath, output string, config SnapshotConfig, stdout io.Writer) error {
+	if config.BaseDomain == "" {
+		return errors.New("'base-domain' argument is required")
+	}
+	fixture, err := loadRenderFixture(fixturePath)
+	if err != nil {
+		return err
+	}
+	if output == "" {
+		return renderSnapshot(ctx, fixture, config, stdout)
+	}
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	if err := renderSnapshot(ctx, fixture, config, f); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Rows matching non-empty operation, task and service
+func filterTaskRows(rows []TaskRow, operationID, taskName, service string) []TaskRow {
+	filtered := make([]TaskRow, 0, len(rows))
+	for _, row := range rows {
+		if operationID != "" && row.OperationID != operationID ||
+			taskName != "" && row.TaskName != taskName ||
+			service != "" && row.Service != service {
+			continue
+		}
+		filtered = append(filtered, row)
+	}
+	return filtered
+}
+
+func writeTaskRows(stdout io.Writer, rows []TaskRow) error {
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].OperationID+rows[i].TaskName+rows[i].Service < rows[j].OperationID+rows[j].TaskName+rows[j].Service
+	})
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "DOMAIN\tOPERATION\tTASK\tSERVICE\tPROTOCOL")
+	for _, row := range rows {
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", row.Domain, row.OperationID, row.TaskName, row.Service, row.Protocol)
+	}
+	return w.Flush()
+}
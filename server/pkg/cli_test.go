@@ -0,0 +1,80 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCommandArgs(t *testing.T) {
+	testCases := []struct {
+		name               string
+		args               []string
+		expectedPositional []string
+		expectedPath       string
+	}{
+		{
+			name:         "no arguments",
+			expectedPath: "/",
+		},
+		{
+			name:               "flags before positional",
+			args:               []string{"--path", "/api", "abcdef12.example.net"},
+			expectedPositional: []string{"abcdef12.example.net"},
+			expectedPath:       "/api",
+		},
+		{
+			name:               "flags after positional",
+			args:               []string{"abcdef12.example.net", "--path=/api"},
+			expectedPositional: []string{"abcdef12.example.net"},
+			expectedPath:       "/api",
+		},
+		{
+			name:               "flags between positional",
+			args:               []string{"op1", "--path", "/api", "driver", "ui"},
+			expectedPositional: []string{"op1", "driver", "ui"},
+			expectedPath:       "/api",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			path := fs.String("path", "/", "")
+			positional, err := parseCommandArgs(fs, tc.args)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedPositional, positional)
+			assert.Equal(t, tc.expectedPath, *path)
+		})
+	}
+}
+
+func TestResolveWithoutYT(t *testing.T) {
+	var stdout bytes.Buffer
+	err := RunCommand(
+		context.Background(),
+		"resolve",
+		[]string{"op1", "driver", "ui", "--base-domain", "example.net"},
+		&stdout,
+	)
+	require.NoError(t, err)
+	task := Task{operationID: "op1", taskName: "driver", service: "ui"}
+	assert.Equal(t, getTaskDomain(Hash([]byte(task.ID())), "example.net")+"\n", stdout.String())
+}
+
+func TestFilterTaskRows(t *testing.T) {
+	rows := []TaskRow{
+		{Hash: "00000001", OperationID: "op1", TaskName: "driver", Service: "ui", Domain: "00000001.example.net"},
+		{Hash: "00000002", OperationID: "op1", TaskName: "history", Service: "ui", Domain: "00000002.example.net"},
+		{Hash: "00000003", OperationID: "op2", TaskName: "jupyter", Service: "lab", Domain: "00000003.example.net"},
+	}
+
+	assert.Equal(t, rows[:2], filterTaskRows(rows, "op1", "", ""))
+	assert.Equal(t, rows[1:2], filterTaskRows(rows, "op1", "history", "ui"))
+	assert.Equal(t, rows, filterTaskRows(rows, "", "", ""))
+	assert.Empty(t, filterTaskRows(rows, "op3", "", ""))
+}
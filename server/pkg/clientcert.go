@@ -0,0 +1,101 @@
+package pkg
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Whether Envoy asks TLS clients for certificates, verified with client CA
+type ClientCertificateMode string
+
+const (
+	ClientCertificateNone ClientCertificateMode = ""
+	// certificate is optional, clients without it authenticate with YT credentials
+	ClientCertificateAccept ClientCertificateMode = "accept"
+	// connections without valid certificate are rejected by Envoy
+	ClientCertificateRequire ClientCertificateMode = "require"
+)
+
+func ParseClientCertificateMode(value string) (ClientCertificateMode, error) {
+	switch mode := ClientCertificateMode(value); mode {
+	case ClientCertificateNone, ClientCertificateAccept, ClientCertificateRequire:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown client certificate mode %q, 'accept' or 'require' are supported", value)
+	}
+}
+
+// YT users of client certificates, e.g. of robots calling task services without YT tokens
+type ClientCertificateMapping struct {
+	Users []ClientCertificateUser `yaml:"users"`
+}
+
+// Certificate is matched by exact subject or SAN, only one of them is set
+type ClientCertificateUser struct {
+	// distinguished name as Go formats it, e.g. CN=robot-etl,O=Example
+	Subject string `yaml:"subject"`
+	// DNS, URI or email SAN, e.g. spiffe://cluster.local/ns/ml/sa/trainer
+	SAN  string `yaml:"san"`
+	User string `yaml:"user"`
+}
+
+// Reads YAML file with 'users' list of client certificates
+func LoadClientCertificateMapping(path string) (*ClientCertificateMapping, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var mapping ClientCertificateMapping
+	if err := yaml.Unmarshal(data, &mapping); err != nil {
+		return nil, fmt.Errorf("invalid client certificate mapping: %v", err)
+	}
+	for i, entry := range mapping.Users {
+		if (entry.Subject == "") == (entry.SAN == "") {
+			return nil, fmt.Errorf("either 'subject' or 'san' is required for client certificate user #%d", i)
+		}
+		if entry.User == "" {
+			return nil, fmt.Errorf("'user' is required for client certificate user #%d", i)
+		}
+	}
+	return &mapping, nil
+}
+
+// YT user of certificate, empty if it's not mapped; SANs are matched before subject
+func (m *ClientCertificateMapping) user(cert *x509.Certificate) string {
+	sans := append(append([]string{}, cert.DNSNames...), cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	for _, san := range sans {
+		for _, entry := range m.Users {
+			if entry.SAN != "" && entry.SAN == san {
+				return entry.User
+			}
+		}
+	}
+	subject := cert.Subject.String()
+	for _, entry := range m.Users {
+		if entry.Subject != "" && entry.Subject == subject {
+			return entry.User
+		}
+	}
+	return ""
+}
+
+// Parses URL-encoded PEM peer certificate sent by Envoy ext_authz filter
+func parsePeerCertificate(encoded string) (*x509.Certificate, error) {
+	data, err := url.PathUnescape(encoded)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
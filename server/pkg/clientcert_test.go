@@ -0,0 +1,123 @@
+package pkg
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadClientCertificateMapping(t *testing.T) {
+	testCases := []struct {
+		name          string
+		config        string
+		expected      *ClientCertificateMapping
+		expectedError string
+	}{
+		{
+			name: "subject and SAN",
+			config: `
+users:
+  - subject: CN=robot-etl,O=Example
+    user: robot-etl
+  - san: spiffe://cluster.local/ns/ml/sa/trainer
+    user: robot-trainer
+`,
+			expected: &ClientCertificateMapping{Users: []ClientCertificateUser{
+				{Subject: "CN=robot-etl,O=Example", User: "robot-etl"},
+				{SAN: "spiffe://cluster.local/ns/ml/sa/trainer", User: "robot-trainer"},
+			}},
+		},
+		{
+			name:          "both subject and SAN",
+			config:        "users: [{subject: CN=robot, san: robot.example.net, user: robot}]",
+			expectedError: "either 'subject' or 'san'",
+		},
+		{
+			name:          "no user",
+			config:        "users: [{san: robot.example.net}]",
+			expectedError: "'user' is required",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "users.yaml")
+			require.NoError(t, os.WriteFile(path, []byte(tc.config), 0o644))
+
+			mapping, err := LoadClientCertificateMapping(path)
+			if tc.expectedError != "" {
+				require.ErrorContains(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, mapping)
+		})
+	}
+}
+
+func TestCheckClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCertificate(t, dir, "robot.example.net")
+	certPEM, err := os.ReadFile(filepath.Join(dir, tlsCertFileName))
+	require.NoError(t, err)
+	cert, err := parsePeerCertificate(url.PathEscape(string(certPEM)))
+	require.NoError(t, err)
+
+	s := CreateAuthServer(createTestLogger(), "")
+	require.NoError(t, s.AddCluster("", nil, YTConnection{Proxy: "localhost"}))
+	s.SetHashToTasks(map[string]Task{
+		"00000001": {operationID: "op1", taskName: "driver", service: "ui"},
+	})
+
+	for _, tt := range []struct {
+		name           string
+		mapping        *ClientCertificateMapping
+		expectedUser   string
+		expectedReason string
+	}{
+		{
+			name:           "mapping by SAN",
+			mapping:        &ClientCertificateMapping{Users: []ClientCertificateUser{{SAN: "robot.example.net", User: "robot"}}},
+			expectedUser:   "robot",
+			expectedReason: authReasonInvalidOperationID, // user is identified, operation is checked next
+		},
+		{
+			name:           "mapping by subject",
+			mapping:        &ClientCertificateMapping{Users: []ClientCertificateUser{{Subject: "CN=robot.example.net", User: "robot"}}},
+			expectedUser:   "robot",
+			expectedReason: authReasonInvalidOperationID,
+		},
+		{
+			name:           "not mapped",
+			mapping:        &ClientCertificateMapping{Users: []ClientCertificateUser{{SAN: "other.example.net", User: "other"}}},
+			expectedReason: authReasonNoCredentials,
+		},
+		{
+			name:           "no mapping",
+			expectedReason: authReasonNoCredentials,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.mapping != nil {
+				assert.Equal(t, tt.expectedUser, tt.mapping.user(cert))
+			}
+			s.SetClientCertificateMapping(tt.mapping)
+
+			request := makeCheckRequest("00000001.example.net", "/", nil)
+			request.Attributes.Source = &authv3.AttributeContext_Peer{Certificate: url.PathEscape(string(certPEM))}
+			decisions := authDecisions.WithLabelValues("denied", tt.expectedReason)
+			before := testutil.ToFloat64(decisions)
+
+			_, err := s.Check(context.Background(), request)
+			require.NoError(t, err)
+			assert.Equal(t, before+1, testutil.ToFloat64(decisions))
+		})
+	}
+}
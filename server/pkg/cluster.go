@@ -0,0 +1,65 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+
+	"gopkg.in/yaml.v3"
+)
+
+// YT cluster whose operations are proxied
+type ClusterConfig struct {
+	// part of task domains, <hash>.<name>.<base domain>; empty for single cluster server
+	Name         string `yaml:"name"`
+	YTConnection `yaml:",inline"`
+	// connection of clients with user credentials, the same as cluster one if its proxy is empty
+	UserConnection YTConnection `yaml:"user_connection"`
+	TokenPath      string       `yaml:"token_path"`
+	// Task proxy directory with services tables and leader lock
+	DirPath string `yaml:"dir_path"`
+}
+
+func (c ClusterConfig) GetUserConnection() YTConnection {
+	if c.UserConnection.Proxy == "" {
+		return c.YTConnection
+	}
+	return c.UserConnection
+}
+
+type clustersConfig struct {
+	Clusters []ClusterConfig `yaml:"clusters"`
+}
+
+// cluster name is a domain label
+var clusterNameRe = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// Reads YAML file with 'clusters' list of multi-cluster server
+func LoadClustersConfig(path string) ([]ClusterConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config clustersConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid clusters config: %v", err)
+	}
+	if len(config.Clusters) == 0 {
+		return nil, fmt.Errorf("no clusters in clusters config")
+	}
+
+	names := make(map[string]bool)
+	for _, cluster := range config.Clusters {
+		if !clusterNameRe.MatchString(cluster.Name) {
+			return nil, fmt.Errorf("invalid cluster name %q, lowercase letters, digits and '-' are allowed", cluster.Name)
+		}
+		if names[cluster.Name] {
+			return nil, fmt.Errorf("duplicate cluster %q", cluster.Name)
+		}
+		names[cluster.Name] = true
+		if cluster.Proxy == "" || cluster.TokenPath == "" || cluster.DirPath == "" {
+			return nil, fmt.Errorf("'proxy', 'token_path' and 'dir_path' are required for cluster %q", cluster.Name)
+		}
+	}
+	return config.Clusters, nil
+}
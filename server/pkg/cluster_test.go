@@ -0,0 +1,114 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadClustersConfig(t *testing.T) {
+	testCases := []struct {
+		name          string
+		config        string
+		expected      []ClusterConfig
+		expectedError string
+	}{
+		{
+			name: "two clusters",
+			config: `
+clusters:
+  - name: hahn
+    proxy: http-proxies-lb.hahn.svc.cluster.local
+    token_path: /etc/yt/hahn/token
+    dir_path: //sys/task_proxies
+  - name: arnold
+    proxy: arnold.yt.example.net
+    use_tls: true
+    proxy_discovery: true
+    user_connection:
+      proxy: https://arnold.yt.example.net
+      ca_path: /etc/yt/ca.pem
+    token_path: /etc/yt/arnold/token
+    dir_path: //home/task_proxies
+`,
+			expected: []ClusterConfig{
+				{
+					Name:         "hahn",
+					YTConnection: YTConnection{Proxy: "http-proxies-lb.hahn.svc.cluster.local"},
+					TokenPath:    "/etc/yt/hahn/token",
+					DirPath:      "//sys/task_proxies",
+				},
+				{
+					Name:           "arnold",
+					YTConnection:   YTConnection{Proxy: "arnold.yt.example.net", UseTLS: true, ProxyDiscovery: true},
+					UserConnection: YTConnection{Proxy: "https://arnold.yt.example.net", CAPath: "/etc/yt/ca.pem"},
+					TokenPath:      "/etc/yt/arnold/token",
+					DirPath:        "//home/task_proxies",
+				},
+			},
+		},
+		{
+			name:          "no clusters",
+			config:        "clusters: []",
+			expectedError: "no clusters",
+		},
+		{
+			name: "invalid name",
+			config: `
+clusters:
+  - name: Hahn.cluster
+    proxy: hahn
+    token_path: /etc/yt/hahn/token
+    dir_path: //sys/task_proxies
+`,
+			expectedError: "invalid cluster name",
+		},
+		{
+			name: "duplicate name",
+			config: `
+clusters:
+  - {name: hahn, proxy: hahn, token_path: /token, dir_path: //sys/task_proxies}
+  - {name: hahn, proxy: hahn, token_path: /token, dir_path: //sys/task_proxies}
+`,
+			expectedError: "duplicate cluster",
+		},
+		{
+			name: "no proxy",
+			config: `
+clusters:
+  - {name: hahn, token_path: /token, dir_path: //sys/task_proxies}
+`,
+			expectedError: "required",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "clusters.yaml")
+			require.NoError(t, os.WriteFile(path, []byte(tc.config), 0o644))
+
+			clusters, err := LoadClustersConfig(path)
+			if tc.expectedError != "" {
+				require.ErrorContains(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, clusters)
+			assert.Equal(t, clusters[0].YTConnection, clusters[0].GetUserConnection())
+		})
+	}
+}
+
+func TestClusterTaskDomain(t *testing.T) {
+	task := Task{operationID: "op1", taskName: "driver", service: "ui"}
+	clusterTask := task
+	clusterTask.cluster = "hahn"
+
+	assert.Equal(t, "00000001.example.net", task.domain("00000001", "example.net"))
+	assert.Equal(t, "00000001.hahn.example.net", clusterTask.domain("00000001", "example.net"))
+	// the same operation ID on other cluster is other task
+	assert.NotEqual(t, Hash([]byte(task.ID())), Hash([]byte(clusterTask.ID())))
+}
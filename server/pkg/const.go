@@ -5,7 +5,13 @@ const (
 
 	proxyPort  = 8080
 	serverPort = 9090
+	adminPort  = 9091
+	// admin API is not exposed outside of pod
+	adminAPIAddress = "127.0.0.1:9092"
+	// plaintext port redirecting to HTTPS when TLS is enabled
+	redirectProxyPort = 8081
 
-	TLSCrtPath = "/etc/certs/tls.crt"
-	TLSKeyPath = "/etc/certs/tls.key"
+	defaultStickyCookieName = "yt-task-proxy-affinity"
+
+	systemCABundlePath = "/etc/ssl/certs/ca-certificates.crt"
 )
@@ -2,78 +2,197 @@ package pkg
 
 import (
 	"context"
+	"crypto/x509"
 	"fmt"
+	"maps"
 	"net"
 	"net/url"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.ytsaurus.tech/yt/go/migrate"
+	"go.ytsaurus.tech/yt/go/schema"
 	"go.ytsaurus.tech/yt/go/ypath"
 	"go.ytsaurus.tech/yt/go/yson"
 	ytsdk "go.ytsaurus.tech/yt/go/yt"
+	"go.ytsaurus.tech/yt/go/yterrors"
 )
 
-const servicesTableName = "services"
+const (
+	servicesTableName = "services"
+	historyTableName  = "services_history"
+)
+
+// Unchanged rows get new last_seen not more often than this period
+const lastSeenRefreshPeriod = 10 * time.Minute
+
+// attribute of services table with time of last discovery saved by leader, followers check that leader is alive
+const lastDiscoveryAttr = "last_discovery_time"
+
+// Discovery providers, each handles its own kind of operations
+const (
+	spytDirectSubmitProvider      = "spyt_direct_submit"
+	spytStandaloneClusterProvider = "spyt_standalone_cluster"
+	taskProxyAnnotationProvider   = "task_proxy_annotation"
+)
 
 type taskDiscovery struct {
+	// cluster name of discovered tasks, empty for single cluster server
+	cluster    string
 	baseDomain string
 	tablePath  ypath.Path
 	yt         ytsdk.Client
 
-	logger *SimpleLogger
+	// history table is not written if TTL is zero
+	historyTablePath ypath.Path
+	historyTTL       time.Duration
+
+	// errors of last discovery cycle, for admin API
+	mx              sync.RWMutex
+	operationErrors []OperationError
+
+	// services table content after last save, nil if unknown; used by updater only
+	savedRows map[string]TaskRow
+
+	logger *Logger
+}
+
+// Error of operation discovery, or of cluster discovery as a whole without operation
+type OperationError struct {
+	Cluster     string    `json:"cluster,omitempty"`
+	OperationID string    `json:"operation_id,omitempty"`
+	Provider    string    `json:"provider,omitempty"`
+	Error       string    `json:"error"`
+	Time        time.Time `json:"time"`
 }
 
-func CreateTaskDiscovery(baseDomain string, dirPath string, yt ytsdk.Client, logger *SimpleLogger) *taskDiscovery {
+func CreateTaskDiscovery(
+	cluster string,
+	baseDomain string,
+	dirPath string,
+	historyTTL time.Duration,
+	yt ytsdk.Client,
+	logger *Logger,
+) *taskDiscovery {
 	return &taskDiscovery{
+		cluster:    cluster,
 		baseDomain: baseDomain,
 		tablePath:  ypath.Path(dirPath).Child(servicesTableName),
 		yt:         yt,
 
+		historyTablePath: ypath.Path(dirPath).Child(historyTableName),
+		historyTTL:       historyTTL,
+
+		operationErrors: make([]OperationError, 0),
+
 		logger: logger,
 	}
 }
 
 func (d *taskDiscovery) Discovery(ctx context.Context) (TaskList, error) {
+	ctx, span := tracer.Start(ctx, "taskDiscovery.Discovery")
+	start := time.Now()
+	tasks, err := d.discovery(ctx)
+	discoveryCycleDuration.WithLabelValues(outcome(err)).Observe(time.Since(start).Seconds())
+	span.SetAttributes(attribute.Int("tasks", len(tasks)))
+	endSpan(span, err)
+	return tasks, err
+}
+
+func (d *taskDiscovery) discovery(ctx context.Context) (TaskList, error) {
 	var tasks []Task
 
 	// TODO: listing all running operations is inefficient
 	// Later we will make separate task proxy spec in operations and will request only for operations with it.
-	operations, err := d.listOperations(ctx)
+	operations, err := d.listOperations(ctx, "")
 	if err != nil {
 		return nil, err
 	}
 
-	d.logger.Debugf("found %d running operations", len(operations))
+	d.logger.Debug("found running operations", "count", len(operations))
+
+	operationErrors := make([]OperationError, 0)
 
 	for _, op := range operations {
 		title := parseOperationTitle(op)
 		annotations := op.RuntimeParameters.Annotations
 
-		var opTasks []Task
+		var process func(ctx context.Context, op ytsdk.OperationStatus) ([]Task, error)
+		var provider string
 		if strings.HasPrefix(title, "Spark driver for") {
-			opTasks, err = processSPYTDirectSubmitOperation(op)
-			if err != nil {
-				d.logger.Errorf("unable to process SPYT direct submit operation %q: %v", op.ID, err)
-				continue
+			provider = spytDirectSubmitProvider
+			process = func(_ context.Context, op ytsdk.OperationStatus) ([]Task, error) {
+				return processSPYTDirectSubmitOperation(op)
 			}
 		} else if annotations["is_spark"] == true {
-			opTasks, err = d.processSPYTStandaloneClusterOperation(ctx, op)
-			if err != nil {
-				d.logger.Errorf("unable to process SPYT standalone cluster operation %q: %v", op.ID, err)
-				continue
-			}
+			provider = spytStandaloneClusterProvider
+			process = d.processSPYTStandaloneClusterOperation
 		} else if _, ok := annotations["task_proxy"]; ok {
-			opTasks, err = d.processTaskProxyAnnotatedOperation(ctx, op)
-			if err != nil {
-				d.logger.Errorf("unable to process task proxy annotated operation %q: %v", op.ID, err)
-				continue
-			}
+			provider = taskProxyAnnotationProvider
+			process = d.processTaskProxyAnnotatedOperation
+		} else {
+			continue
+		}
+
+		opCtx, span := tracer.Start(ctx, "discovery."+provider, trace.WithAttributes(
+			attribute.String("operation_id", op.ID.String()),
+		))
+		start := time.Now()
+		opTasks, err := process(opCtx, op)
+		discoveryDuration.WithLabelValues(provider, outcome(err)).Observe(time.Since(start).Seconds())
+		endSpan(span, err)
+		if err != nil {
+			d.logger.Error("unable to process operation", "provider", provider, "operation_id", op.ID.String(), "error", err)
+			operationErrors = append(operationErrors, OperationError{
+				Cluster:     d.cluster,
+				OperationID: op.ID.String(),
+				Provider:    provider,
+				Error:       err.Error(),
+				Time:        time.Now(),
+			})
+			continue
+		}
+		for i := range opTasks {
+			opTasks[i].cluster = d.cluster
+			opTasks[i].user = op.AuthenticatedUser
+			opTasks[i].pool = parseOperationPool(op)
+			opTasks[i].provider = provider
 		}
 		tasks = append(tasks, opTasks...)
 	}
+
+	jobs := 0
+	for _, task := range tasks {
+		jobs += len(task.jobs)
+	}
+	d.setOperationErrors(operationErrors)
+
+	discoveredOperations.Set(float64(len(operations)))
+	discoveredTasks.Set(float64(len(tasks)))
+	discoveredJobs.Set(float64(jobs))
+
 	return tasks, nil
 }
 
+func (d *taskDiscovery) setOperationErrors(operationErrors []OperationError) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	d.operationErrors = operationErrors
+}
+
+func (d *taskDiscovery) getOperationErrors() []OperationError {
+	d.mx.RLock()
+	defer d.mx.RUnlock()
+
+	return d.operationErrors
+}
+
 func processSPYTDirectSubmitOperation(op ytsdk.OperationStatus) ([]Task, error) {
 	descriptionAny, ok := op.RuntimeParameters.Annotations["description"]
 	if !ok {
@@ -159,7 +278,9 @@ func (d *taskDiscovery) processSPYTStandaloneClusterOperation(ctx context.Contex
 		},
 	} {
 		var nodes []string
-		err := d.yt.ListNode(ctx, ypath.Path(discoveryPath).Child("discovery").Child(t.dir), &nodes, nil)
+		err := doYTRequest(ctx, "list_node", func(ctx context.Context) error {
+			return d.yt.ListNode(ctx, ypath.Path(discoveryPath).Child("discovery").Child(t.dir), &nodes, nil)
+		})
 		if err != nil {
 			if t.taskName == "history" {
 				// history server is optionally enabled in spark conf
@@ -195,8 +316,12 @@ func (d *taskDiscovery) processTaskProxyAnnotatedOperation(ctx context.Context,
 		return nil, fmt.Errorf("invalid task_proxy annotation: %v", taskProxyAnnotation)
 	}
 
-	listJobs, err := d.yt.ListJobs(ctx, op.ID, &ytsdk.ListJobsOptions{
-		JobState: &ytsdk.JobRunning,
+	var listJobs *ytsdk.ListJobsResult
+	err := doYTRequest(ctx, "list_jobs", func(ctx context.Context) (err error) {
+		listJobs, err = d.yt.ListJobs(ctx, op.ID, &ytsdk.ListJobsOptions{
+			JobState: &ytsdk.JobRunning,
+		})
+		return err
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to list jobs: %v", err)
@@ -206,18 +331,20 @@ func (d *taskDiscovery) processTaskProxyAnnotatedOperation(ctx context.Context,
 
 	for _, job := range listJobs.Jobs {
 		var jobPorts []int
-		err = d.yt.GetNode(
-			ctx,
-			ypath.Path(
-				fmt.Sprintf(
-					"//sys/exec_nodes/%s/orchid/exec_node/job_controller/active_jobs/%s/job_ports",
-					job.Address,
-					job.ID,
+		err = doYTRequest(ctx, "get_node", func(ctx context.Context) error {
+			return d.yt.GetNode(
+				ctx,
+				ypath.Path(
+					fmt.Sprintf(
+						"//sys/exec_nodes/%s/orchid/exec_node/job_controller/active_jobs/%s/job_ports",
+						job.Address,
+						job.ID,
+					),
 				),
-			),
-			&jobPorts,
-			nil,
-		)
+				&jobPorts,
+				nil,
+			)
+		})
 		if err != nil {
 			return nil, fmt.Errorf("failed to list job %q ports: %v", job.ID, err)
 		}
@@ -242,6 +369,8 @@ func (d *taskDiscovery) processTaskProxyAnnotatedOperation(ctx context.Context,
 				taskName:    job.TaskName,
 				service:     serviceInfo.service,
 				protocol:    serviceInfo.protocol,
+				options:     serviceInfo.options,
+				rawOptions:  getRawServiceOptions(taskProxyAnnotation, job.TaskName, serviceInfo.service),
 			}
 			if _, ok := idToTask[taskProto.ID()]; !ok {
 				idToTask[taskProto.ID()] = &taskProto
@@ -252,6 +381,7 @@ func (d *taskDiscovery) processTaskProxyAnnotatedOperation(ctx context.Context,
 				host: hostParts[0],
 				port: uint32(port),
 			})
+			task.jobIDs = append(task.jobIDs, job.ID.String())
 		}
 	}
 
@@ -262,55 +392,272 @@ func (d *taskDiscovery) processTaskProxyAnnotatedOperation(ctx context.Context,
 	return tasks, nil
 }
 
-func (d *taskDiscovery) save(ctx context.Context, hashToTask map[string]Task) error {
-	exists, err := d.yt.NodeExists(ctx, d.tablePath, nil)
+// Creates services and history sorted dynamic tables or migrates them,
+// static services table of previous versions is replaced
+func (d *taskDiscovery) ensureTable(ctx context.Context) error {
+	onConflict := func(path ypath.Path, actual, expected schema.Schema) error {
+		var dynamic bool
+		if err := d.yt.GetNode(ctx, path.Attr("dynamic"), &dynamic, nil); err != nil {
+			return err
+		}
+		if !dynamic {
+			d.logger.Info("replacing static services table with dynamic one", "path", path)
+			if err := d.yt.RemoveNode(ctx, path, nil); err != nil {
+				return err
+			}
+			return migrate.RetryConflict
+		}
+		d.logger.Info("altering table schema", "path", path)
+		return migrate.OnConflictTryAlter(ctx, d.yt)(path, actual, expected)
+	}
+	tables := map[ypath.Path]migrate.Table{
+		d.tablePath: {Schema: schema.MustInfer(&TaskRow{})},
+	}
+	if d.historyTTL > 0 {
+		// old events are removed by compaction
+		attributes := map[string]any{
+			"auto_compaction_period": d.historyTTL.Milliseconds(),
+		}
+		migrate.DeleteDataAfterTTL(d.historyTTL).FillAttrs(attributes)
+		tables[d.historyTablePath] = migrate.Table{
+			Schema:     schema.MustInfer(&TaskEventRow{}),
+			Attributes: attributes,
+		}
+	}
+	return doYTRequest(ctx, "ensure_tables", func(ctx context.Context) error {
+		return migrate.EnsureTables(ctx, d.yt, tables, onConflict)
+	})
+}
+
+// Applies difference between saved and new rows in one tablet transaction
+func (d *taskDiscovery) save(ctx context.Context, hashToTask map[string]Task, tls bool, leaderTxID ytsdk.TxID) error {
+	if d.savedRows == nil {
+		if err := d.ensureTable(ctx); err != nil {
+			return err
+		}
+		// state written by previous server instance
+		rows, err := d.load(ctx)
+		if err != nil {
+			return err
+		}
+		d.savedRows = make(map[string]TaskRow)
+		for _, row := range rows {
+			d.savedRows[row.Hash] = row
+		}
+	}
+
+	rows := make(map[string]TaskRow)
+	for hash, task := range hashToTask {
+		rows[hash] = makeTaskRow(hash, task, d.baseDomain, tls)
+	}
+	now, err := schema.NewTimestamp(time.Now())
 	if err != nil {
 		return err
 	}
-	if !exists {
-		_, err := d.yt.CreateNode(ctx, d.tablePath, ytsdk.NodeTable, nil)
+	// events go first, as diff sets seen timestamps of rows
+	var events []any
+	if d.historyTTL > 0 {
+		events = diffTaskEvents(d.savedRows, rows, now)
+	}
+	inserts, deletes := diffTaskRows(d.savedRows, rows, now)
+	if len(inserts) == 0 && len(deletes) == 0 {
+		return nil
+	}
+	d.logger.Debug("updating services table", "inserts", len(inserts), "deletes", len(deletes), "events", len(events))
+
+	err = doYTRequest(ctx, "modify_rows", func(ctx context.Context) error {
+		tx, err := d.yt.BeginTabletTx(ctx, nil)
 		if err != nil {
 			return err
 		}
-	}
-	w, err := d.yt.WriteTable(ctx, d.tablePath, nil)
+		if len(inserts) > 0 {
+			if err := tx.InsertRows(ctx, d.tablePath, inserts, nil); err != nil {
+				_ = tx.Abort()
+				return err
+			}
+		}
+		if len(deletes) > 0 {
+			if err := tx.DeleteRows(ctx, d.tablePath, deletes, nil); err != nil {
+				_ = tx.Abort()
+				return err
+			}
+		}
+		if len(events) > 0 {
+			if err := tx.InsertRows(ctx, d.historyTablePath, events, nil); err != nil {
+				_ = tx.Abort()
+				return err
+			}
+		}
+		return commitTabletTx(ctx, tx, leaderTxID)
+	})
 	if err != nil {
+		// table state is unknown now, it is loaded again on next save
+		d.savedRows = nil
 		return err
 	}
-	for hash, task := range hashToTask {
-		err = w.Write(&TaskRow{
-			OperationID: task.operationID,
-			TaskName:    task.taskName,
-			Service:     task.service,
-			Protocol:    string(task.protocol),
-			Domain:      getTaskDomain(hash, d.baseDomain),
+	d.savedRows = rows
+	return nil
+}
+
+// Tablet transaction is not nested into leader one, so leader transaction is its prerequisite:
+// commit fails if leader lock is lost meanwhile
+func commitTabletTx(ctx context.Context, tx ytsdk.TabletTx, leaderTxID ytsdk.TxID) error {
+	txClient, ok := tx.(ytsdk.LowLevelTxClient)
+	if !ok {
+		_ = tx.Abort()
+		return fmt.Errorf("tablet transaction %s can't be committed with prerequisite", tx.ID())
+	}
+	return txClient.CommitTx(ctx, tx.ID(), &ytsdk.CommitTxOptions{
+		Sticky:              true,
+		PrerequisiteOptions: &ytsdk.PrerequisiteOptions{TransactionIDs: []ytsdk.TxID{leaderTxID}},
+	})
+}
+
+// Rows to insert (new, changed or not refreshed for lastSeenRefreshPeriod) and keys to delete, sorted by hash;
+// rows get first_seen of saved ones and last_seen is updated for inserted rows only
+func diffTaskRows(saved, rows map[string]TaskRow, now schema.Timestamp) ([]any, []any) {
+	var inserts, deletes []any
+	for _, hash := range slices.Sorted(maps.Keys(rows)) {
+		row := rows[hash]
+		row.FirstSeen, row.LastSeen = now, now
+		if savedRow, ok := saved[hash]; ok {
+			if savedRow.FirstSeen != 0 {
+				row.FirstSeen = savedRow.FirstSeen
+			}
+			if row.sameTask(savedRow) && now.Time().Sub(savedRow.LastSeen.Time()) < lastSeenRefreshPeriod {
+				row.LastSeen = savedRow.LastSeen
+				rows[hash] = row
+				continue
+			}
+		}
+		rows[hash] = row
+		inserts = append(inserts, row)
+	}
+	for _, hash := range slices.Sorted(maps.Keys(saved)) {
+		if _, ok := rows[hash]; !ok {
+			deletes = append(deletes, taskRowKey{Hash: hash})
+		}
+	}
+	return inserts, deletes
+}
+
+// History events of tasks: appeared, moved to other jobs or disappeared, sorted by hash
+func diffTaskEvents(saved, rows map[string]TaskRow, now schema.Timestamp) []any {
+	var events []any
+	for _, hash := range slices.Sorted(maps.Keys(rows)) {
+		row := rows[hash]
+		savedRow, ok := saved[hash]
+		if !ok {
+			events = append(events, makeTaskEventRow(now, taskAppeared, row))
+		} else if !slices.Equal(savedRow.Endpoints, row.Endpoints) || !slices.Equal(savedRow.JobIDs, row.JobIDs) {
+			events = append(events, makeTaskEventRow(now, taskMoved, row))
+		}
+	}
+	for _, hash := range slices.Sorted(maps.Keys(saved)) {
+		if _, ok := rows[hash]; !ok {
+			events = append(events, makeTaskEventRow(now, taskDisappeared, saved[hash]))
+		}
+	}
+	return events
+}
+
+// Tasks restored from services table, as written by leader; rows not seen by leader for maxAge are skipped,
+// as their jobs can be gone and hosts reused by other operations
+func (d *taskDiscovery) LoadTasks(ctx context.Context, maxAge time.Duration) (TaskList, error) {
+	rows, err := d.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tasks := make(TaskList, 0, len(rows))
+	for _, row := range rows {
+		if age := time.Since(row.LastSeen.Time()); age > maxAge {
+			d.logger.Warn("skipping stale services table row", "hash", row.Hash, "last_seen", row.LastSeen.Time())
+			continue
+		}
+		task, err := row.task(d.cluster)
+		if err != nil {
+			d.logger.Warn("skipping invalid services table row", "hash", row.Hash, "error", err)
+			continue
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, nil
+}
+
+// Marks services table as written by leader with fresh discovery
+func (d *taskDiscovery) setLastDiscoveryTime(ctx context.Context, t time.Time, leaderTxID ytsdk.TxID) error {
+	return doYTRequest(ctx, "set_node", func(ctx context.Context) error {
+		return d.yt.SetNode(ctx, d.tablePath.Attr(lastDiscoveryAttr), t.UTC().Format(time.RFC3339), &ytsdk.SetNodeOptions{
+			PrerequisiteOptions: &ytsdk.PrerequisiteOptions{TransactionIDs: []ytsdk.TxID{leaderTxID}},
 		})
+	})
+}
+
+// Time of last discovery saved by leader, zero if no leader has saved discovery yet
+func (d *taskDiscovery) getLastDiscoveryTime(ctx context.Context) (time.Time, error) {
+	var value string
+	err := doYTRequest(ctx, "get_node", func(ctx context.Context) error {
+		return d.yt.GetNode(ctx, d.tablePath.Attr(lastDiscoveryAttr), &value, nil)
+	})
+	if yterrors.ContainsResolveError(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// Rows of services table written by last update
+func (d *taskDiscovery) load(ctx context.Context) ([]TaskRow, error) {
+	rows := make([]TaskRow, 0)
+	err := doYTRequest(ctx, "select_rows", func(ctx context.Context) error {
+		r, err := d.yt.SelectRows(ctx, fmt.Sprintf("* from [%s]", d.tablePath), nil)
 		if err != nil {
 			return err
 		}
-	}
-	return w.Commit()
+		defer r.Close()
+		for r.Next() {
+			var row TaskRow
+			if err := r.Scan(&row); err != nil {
+				return err
+			}
+			rows = append(rows, row)
+		}
+		return r.Err()
+	})
+	return rows, err
 }
 
-func (d *taskDiscovery) listOperations(ctx context.Context) ([]ytsdk.OperationStatus, error) {
+// Running operations, of given user only if user is not empty
+func (d *taskDiscovery) listOperations(ctx context.Context, user string) ([]ytsdk.OperationStatus, error) {
 	var operations []ytsdk.OperationStatus
 	var cursor *yson.Time
 	limit := 100
 	cursorDirection := ytsdk.SortDirectionPast
+	var userFilter *string
+	if user != "" {
+		userFilter = &user
+	}
 
 	for {
-		d.logger.Debugf(
-			"loading running operations chunk, limit %d, cursor %s, already loaded %d operations",
-			limit,
-			cursor,
-			len(operations),
+		d.logger.Debug(
+			"loading running operations chunk",
+			"limit", limit,
+			"cursor", cursor,
+			"loaded", len(operations),
 		)
-		resp, err := d.yt.ListOperations(ctx, &ytsdk.ListOperationsOptions{
-			State:           &ytsdk.StateRunning,
-			Cursor:          cursor,
-			CursorDirection: &cursorDirection,
-			Limit:           &limit,
-			Attributes:      []string{"id", "runtime_parameters", "brief_spec"},
+		var resp *ytsdk.ListOperationsResult
+		err := doYTRequest(ctx, "list_operations", func(ctx context.Context) (err error) {
+			resp, err = d.yt.ListOperations(ctx, &ytsdk.ListOperationsOptions{
+				State:           &ytsdk.StateRunning,
+				Cursor:          cursor,
+				CursorDirection: &cursorDirection,
+				User:            userFilter,
+				Limit:           &limit,
+				Attributes:      []string{"id", "runtime_parameters", "brief_spec", "authenticated_user"},
+			})
+			return err
 		})
 		if err != nil {
 			return nil, err
@@ -330,6 +677,16 @@ type taskServiceInfo struct {
 	service   string
 	protocol  Protocol
 	portIndex int
+	options   serviceOptions
+}
+
+// Service info as is, to restore options from services table
+func getRawServiceOptions(taskProxyAnnotation any, task, service string) map[string]any {
+	taskProxy, _ := taskProxyAnnotation.(map[string]any)
+	tasksInfo, _ := taskProxy["tasks_info"].(map[string]any)
+	servicesInfo, _ := tasksInfo[task].(map[string]any)
+	info, _ := servicesInfo[service].(map[string]any)
+	return info
 }
 
 func parseTaskProxyAnnotation(taskProxyAny any) []taskServiceInfo {
@@ -385,27 +742,8 @@ func parseTaskProxyAnnotation(taskProxyAny any) []taskServiceInfo {
 			if !ok {
 				continue
 			}
-			var portIndex int
-			switch v := portIndexAny.(type) {
-			case int:
-				portIndex = v
-			case int64:
-				portIndex = int(v)
-			case int32:
-				portIndex = int(v)
-			case int16:
-				portIndex = int(v)
-			case int8:
-				portIndex = int(v)
-			case uint64:
-				portIndex = int(v)
-			case uint32:
-				portIndex = int(v)
-			case uint16:
-				portIndex = int(v)
-			case uint8:
-				portIndex = int(v)
-			default:
+			portIndex, ok := parseInt(portIndexAny)
+			if !ok {
 				continue
 			}
 			taskServiceInfos = append(taskServiceInfos, taskServiceInfo{
@@ -413,6 +751,7 @@ func parseTaskProxyAnnotation(taskProxyAny any) []taskServiceInfo {
 				service:   service,
 				protocol:  Protocol(protocol),
 				portIndex: portIndex,
+				options:   parseServiceOptions(info, Protocol(protocol)),
 			})
 		}
 	}
@@ -420,6 +759,164 @@ func parseTaskProxyAnnotation(taskProxyAny any) []taskServiceInfo {
 	return taskServiceInfos
 }
 
+// Optional service attributes, invalid values are ignored
+func parseServiceOptions(info map[string]any, protocol Protocol) serviceOptions {
+	var options serviceOptions
+	if websocket, ok := info["websocket"].(bool); ok {
+		options.websocket = websocket
+	}
+	if grpcWeb, ok := info["grpc_web"].(bool); ok {
+		options.grpcWeb = grpcWeb
+	}
+	switch upstreamTLS := info["upstream_tls"].(type) {
+	case bool:
+		options.upstreamTLS.enabled = upstreamTLS
+	case map[string]any:
+		options.upstreamTLS.enabled = true
+		if sni, ok := upstreamTLS["sni"].(string); ok {
+			options.upstreamTLS.sni = sni
+		}
+		// invalid CA would make Envoy reject the whole snapshot
+		if ca, ok := upstreamTLS["ca"].(string); ok && x509.NewCertPool().AppendCertsFromPEM([]byte(ca)) {
+			options.upstreamTLS.ca = ca
+		}
+		if skipVerify, ok := upstreamTLS["skip_verify"].(bool); ok {
+			options.upstreamTLS.skipVerify = skipVerify
+		}
+	}
+	if healthCheck, ok := info["health_check"].(map[string]any); ok {
+		options.healthCheck = parseHealthCheckOptions(healthCheck, protocol)
+	}
+	if timeout, ok := parseDuration(info["timeout"]); ok && timeout >= 0 {
+		options.timeout = optionalOf(timeout)
+	}
+	if idleTimeout, ok := parseDuration(info["idle_timeout"]); ok && idleTimeout >= 0 {
+		options.idleTimeout = optionalOf(idleTimeout)
+	}
+	if retryOn, ok := info["retry_on"].(string); ok {
+		options.retryOn = optionalOf(retryOn)
+	}
+	if numRetries, ok := parseInt(info["num_retries"]); ok && numRetries >= 0 {
+		options.numRetries = optionalOf(uint32(numRetries))
+	}
+	switch sticky := info["sticky"].(type) {
+	case bool:
+		if sticky {
+			options.sticky = parseStickyOptions(map[string]any{})
+		}
+	case map[string]any:
+		options.sticky = parseStickyOptions(sticky)
+	}
+	return options
+}
+
+func parseStickyOptions(sticky map[string]any) stickyOptions {
+	options := stickyOptions{
+		enabled:    true,
+		lbPolicy:   ringHashLbPolicy,
+		cookieName: defaultStickyCookieName,
+	}
+	if lbPolicy, ok := sticky["lb_policy"].(string); ok {
+		switch stickyLbPolicy(lbPolicy) {
+		case ringHashLbPolicy, maglevLbPolicy:
+			options.lbPolicy = stickyLbPolicy(lbPolicy)
+		}
+	}
+	if header, ok := sticky["header"].(string); ok {
+		options.header = strings.ToLower(header)
+	}
+	if cookieName, ok := sticky["cookie_name"].(string); ok && cookieName != "" {
+		options.cookieName = cookieName
+	}
+	if cookieTTL, ok := parseDuration(sticky["cookie_ttl"]); ok && cookieTTL >= 0 {
+		options.cookieTTL = optionalOf(cookieTTL)
+	}
+	return options
+}
+
+func parseHealthCheckOptions(healthCheck map[string]any, protocol Protocol) healthCheckOptions {
+	options := healthCheckOptions{
+		enabled:            true,
+		kind:               httpHealthCheck,
+		path:               "/",
+		interval:           10 * time.Second,
+		timeout:            2 * time.Second,
+		healthyThreshold:   1,
+		unhealthyThreshold: 3,
+	}
+	if protocol == GRPC {
+		options.kind = grpcHealthCheck
+	}
+	if kind, ok := healthCheck["type"].(string); ok {
+		switch healthCheckType(kind) {
+		case httpHealthCheck, tcpHealthCheck:
+			options.kind = healthCheckType(kind)
+		case grpcHealthCheck:
+			// Envoy rejects gRPC health check of cluster without HTTP/2
+			if protocol == GRPC {
+				options.kind = grpcHealthCheck
+			}
+		}
+	}
+	if path, ok := healthCheck["path"].(string); ok && strings.HasPrefix(path, "/") {
+		options.path = path
+	}
+	if serviceName, ok := healthCheck["service_name"].(string); ok {
+		options.serviceName = serviceName
+	}
+	if interval, ok := parseDuration(healthCheck["interval"]); ok && interval > 0 {
+		options.interval = interval
+	}
+	if timeout, ok := parseDuration(healthCheck["timeout"]); ok && timeout > 0 {
+		options.timeout = timeout
+	}
+	if threshold, ok := parseInt(healthCheck["healthy_threshold"]); ok && threshold > 0 {
+		options.healthyThreshold = uint32(threshold)
+	}
+	if threshold, ok := parseInt(healthCheck["unhealthy_threshold"]); ok && threshold > 0 {
+		options.unhealthyThreshold = uint32(threshold)
+	}
+	return options
+}
+
+func parseInt(valueAny any) (int, bool) {
+	switch v := valueAny.(type) {
+	case int:
+		return v, true
+	case int64:
+		return int(v), true
+	case int32:
+		return int(v), true
+	case int16:
+		return int(v), true
+	case int8:
+		return int(v), true
+	case uint64:
+		return int(v), true
+	case uint32:
+		return int(v), true
+	case uint16:
+		return int(v), true
+	case uint8:
+		return int(v), true
+	default:
+		return 0, false
+	}
+}
+
+// Duration is either a string like "1m30s" or a number of seconds
+func parseDuration(valueAny any) (time.Duration, bool) {
+	if value, ok := valueAny.(string); ok {
+		duration, err := time.ParseDuration(value)
+		return duration, err == nil
+	}
+	if value, ok := valueAny.(float64); ok {
+		return time.Duration(value * float64(time.Second)), true
+	}
+	seconds, ok := parseInt(valueAny)
+	return time.Duration(seconds) * time.Second, ok
+}
+
 func makeHostPortFromNode(node string) (*HostPort, error) {
 	host, port, err := net.SplitHostPort(node)
 	if err != nil {
@@ -435,6 +932,22 @@ func makeHostPortFromNode(node string) (*HostPort, error) {
 	}, nil
 }
 
+// Pools of operation in all pool trees, comma-separated
+func parseOperationPool(op ytsdk.OperationStatus) string {
+	var pools []string
+	options := op.RuntimeParameters.SchedulingOptionsPerPoolTree
+	for _, tree := range slices.Sorted(maps.Keys(options)) {
+		treeOptions, ok := options[tree].(map[string]any)
+		if !ok {
+			continue
+		}
+		if pool, ok := treeOptions["pool"].(string); ok && !slices.Contains(pools, pool) {
+			pools = append(pools, pool)
+		}
+	}
+	return strings.Join(pools, ",")
+}
+
 func parseOperationTitle(op ytsdk.OperationStatus) string {
 	titleAny, ok := op.BriefSpec["title"]
 	if !ok {
@@ -2,8 +2,13 @@ package pkg
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.ytsaurus.tech/yt/go/schema"
+	"go.ytsaurus.tech/yt/go/yson"
+	ytsdk "go.ytsaurus.tech/yt/go/yt"
 )
 
 func TestParseTaskProxyAnnotation(t *testing.T) {
@@ -34,6 +39,133 @@ func TestParseTaskProxyAnnotation(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "websocket option",
+			annotation: map[string]any{
+				"enabled": true,
+				"tasks_info": map[string]any{
+					"jupyter": map[string]any{
+						"lab": map[string]any{
+							"protocol":   "http",
+							"port_index": 0,
+							"websocket":  true,
+						},
+					},
+				},
+			},
+			expected: []taskServiceInfo{
+				{
+					task:      "jupyter",
+					service:   "lab",
+					protocol:  HTTP,
+					portIndex: 0,
+					options:   serviceOptions{websocket: true},
+				},
+			},
+		},
+		{
+			name: "upstream tls option",
+			annotation: map[string]any{
+				"enabled": true,
+				"tasks_info": map[string]any{
+					"jupyter": map[string]any{
+						"lab": map[string]any{
+							"protocol":   "http",
+							"port_index": 0,
+							"upstream_tls": map[string]any{
+								"sni":         "jupyter.local",
+								"skip_verify": true,
+								// files of proxy container are not available to operations
+								"ca_path": "/etc/shadow",
+								"ca":      "not a certificate",
+							},
+						},
+					},
+				},
+			},
+			expected: []taskServiceInfo{
+				{
+					task:      "jupyter",
+					service:   "lab",
+					protocol:  HTTP,
+					portIndex: 0,
+					options: serviceOptions{upstreamTLS: upstreamTLSOptions{
+						enabled:    true,
+						sni:        "jupyter.local",
+						skipVerify: true,
+					}},
+				},
+			},
+		},
+		{
+			name: "health check option with defaults",
+			annotation: map[string]any{
+				"enabled": true,
+				"tasks_info": map[string]any{
+					"jupyter": map[string]any{
+						"lab": map[string]any{
+							"protocol":   "http",
+							"port_index": 0,
+							"health_check": map[string]any{
+								"type":                "grpc", // ignored for HTTP service
+								"path":                "/api/status",
+								"interval":            "30s",
+								"unhealthy_threshold": uint64(5),
+							},
+						},
+					},
+				},
+			},
+			expected: []taskServiceInfo{
+				{
+					task:      "jupyter",
+					service:   "lab",
+					protocol:  HTTP,
+					portIndex: 0,
+					options: serviceOptions{healthCheck: healthCheckOptions{
+						enabled:            true,
+						kind:               httpHealthCheck,
+						path:               "/api/status",
+						interval:           30 * time.Second,
+						timeout:            2 * time.Second,
+						healthyThreshold:   1,
+						unhealthyThreshold: 5,
+					}},
+				},
+			},
+		},
+		{
+			name: "route options",
+			annotation: map[string]any{
+				"enabled": true,
+				"tasks_info": map[string]any{
+					"master": map[string]any{
+						"rest": map[string]any{
+							"protocol":     "http",
+							"port_index":   1,
+							"timeout":      int64(0),
+							"idle_timeout": "1h",
+							"retry_on":     "connect-failure",
+							"num_retries":  int64(2),
+						},
+					},
+				},
+			},
+			expected: []taskServiceInfo{
+				{
+					task:      "master",
+					service:   "rest",
+					protocol:  HTTP,
+					portIndex: 1,
+					options: serviceOptions{
+						timeout:     optionalOf(time.Duration(0)),
+						idleTimeout: optionalOf(time.Hour),
+						retryOn:     optionalOf("connect-failure"),
+						numRetries:  optionalOf(uint32(2)),
+					},
+				},
+			},
+		},
 		{
 			name: "minimal annotation",
 			annotation: map[string]any{
@@ -109,3 +241,177 @@ func TestParseTaskProxyAnnotation(t *testing.T) {
 		})
 	}
 }
+
+func TestDiffTaskRows(t *testing.T) {
+	seen := schema.Timestamp(1_000_000_000_000_000)
+	recently := seen + schema.Timestamp(time.Minute/time.Microsecond)
+	later := seen + schema.Timestamp(lastSeenRefreshPeriod/time.Microsecond)
+
+	withSeen := func(row TaskRow, firstSeen, lastSeen schema.Timestamp) TaskRow {
+		row.FirstSeen, row.LastSeen = firstSeen, lastSeen
+		return row
+	}
+	row1 := TaskRow{Hash: "00000001", OperationID: "op1", TaskName: "driver", Service: "ui", Protocol: "http"}
+	row2 := TaskRow{Hash: "00000002", OperationID: "op2", TaskName: "jupyter", Service: "lab", Protocol: "http"}
+	row3 := TaskRow{Hash: "00000003", OperationID: "op3", TaskName: "server", Service: "api", Protocol: "grpc"}
+	movedRow2 := row2
+	movedRow2.Endpoints = []string{"node2:8888"}
+
+	for _, tt := range []struct {
+		name            string
+		saved           map[string]TaskRow
+		rows            map[string]TaskRow
+		now             schema.Timestamp
+		expectedInserts []any
+		expectedDeletes []any
+	}{
+		{
+			name:            "empty table",
+			saved:           map[string]TaskRow{},
+			rows:            map[string]TaskRow{row2.Hash: row2, row1.Hash: row1},
+			now:             seen,
+			expectedInserts: []any{withSeen(row1, seen, seen), withSeen(row2, seen, seen)},
+		},
+		{
+			name:  "no changes",
+			saved: map[string]TaskRow{row1.Hash: withSeen(row1, seen, seen), row2.Hash: withSeen(row2, seen, seen)},
+			rows:  map[string]TaskRow{row1.Hash: row1, row2.Hash: row2},
+			now:   recently,
+		},
+		{
+			name:            "no changes, last seen refreshed",
+			saved:           map[string]TaskRow{row1.Hash: withSeen(row1, seen, seen)},
+			rows:            map[string]TaskRow{row1.Hash: row1},
+			now:             later,
+			expectedInserts: []any{withSeen(row1, seen, later)},
+		},
+		{
+			name:            "added, moved and removed",
+			saved:           map[string]TaskRow{row1.Hash: withSeen(row1, seen, seen), row2.Hash: withSeen(row2, seen, seen)},
+			rows:            map[string]TaskRow{row2.Hash: movedRow2, row3.Hash: row3},
+			now:             recently,
+			expectedInserts: []any{withSeen(movedRow2, seen, recently), withSeen(row3, recently, recently)},
+			expectedDeletes: []any{taskRowKey{Hash: row1.Hash}},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			inserts, deletes := diffTaskRows(tt.saved, tt.rows, tt.now)
+			assert.Equal(t, tt.expectedInserts, inserts)
+			assert.Equal(t, tt.expectedDeletes, deletes)
+		})
+	}
+}
+
+func TestParseOperationPool(t *testing.T) {
+	op := ytsdk.OperationStatus{RuntimeParameters: ytsdk.OperationRuntimeParameters{
+		SchedulingOptionsPerPoolTree: map[string]any{
+			"physical": map[string]any{"pool": "research"},
+			"gpu":      map[string]any{"pool": "inference"},
+			"cloud":    map[string]any{"pool": "research"},
+		},
+	}}
+	assert.Equal(t, "research,inference", parseOperationPool(op))
+	assert.Equal(t, "", parseOperationPool(ytsdk.OperationStatus{}))
+}
+
+func TestServicesTableSchema(t *testing.T) {
+	tableSchema := schema.MustInfer(&TaskRow{})
+	assert.Equal(t, "hash", tableSchema.Columns[0].Name)
+	assert.Equal(t, schema.SortAscending, tableSchema.Columns[0].SortOrder)
+	for _, column := range tableSchema.Columns[1:] {
+		assert.Equal(t, schema.SortNone, column.SortOrder, column.Name)
+	}
+}
+
+func TestDiffTaskEvents(t *testing.T) {
+	now := schema.Timestamp(1_000_000_000_000_000)
+	row1 := TaskRow{Hash: "00000001", OperationID: "op1", TaskName: "driver", Service: "ui", Endpoints: []string{"node1:4040"}}
+	row2 := TaskRow{Hash: "00000002", OperationID: "op2", TaskName: "jupyter", Service: "lab", Endpoints: []string{"node1:8888"}}
+	row3 := TaskRow{Hash: "00000003", OperationID: "op3", TaskName: "server", Service: "api", Endpoints: []string{"node3:80"}}
+	movedRow2 := row2
+	movedRow2.Endpoints = []string{"node2:8888"}
+	changedRow3 := row3
+	changedRow3.Protocol = "grpc"
+
+	events := diffTaskEvents(
+		map[string]TaskRow{row1.Hash: row1, row2.Hash: row2, row3.Hash: row3},
+		map[string]TaskRow{row2.Hash: movedRow2, row3.Hash: changedRow3},
+		now,
+	)
+	assert.Equal(t, []any{
+		makeTaskEventRow(now, taskMoved, movedRow2),
+		makeTaskEventRow(now, taskDisappeared, row1),
+	}, events)
+
+	events = diffTaskEvents(map[string]TaskRow{}, map[string]TaskRow{row1.Hash: row1}, now)
+	assert.Equal(t, []any{makeTaskEventRow(now, taskAppeared, row1)}, events)
+}
+
+func TestTaskRowRoundTrip(t *testing.T) {
+	ca, _ := generateTestCertificate(t, "ui.local")
+	rawOptions := map[string]any{
+		"protocol":     "http",
+		"port_index":   int64(1),
+		"websocket":    true,
+		"timeout":      "1m",
+		"sticky":       map[string]any{"lb_policy": "maglev", "cookie_ttl": int64(600)},
+		"upstream_tls": map[string]any{"ca": string(ca)},
+	}
+	task := Task{
+		operationID: "op1",
+		taskName:    "server",
+		service:     "ui",
+		protocol:    HTTP,
+		jobs:        []HostPort{{host: "node1", port: 8080}, {host: "node2", port: 8081}},
+		options:     parseServiceOptions(rawOptions, HTTP),
+		rawOptions:  rawOptions,
+		jobIDs:      []string{"1-2-3-4", "5-6-7-8"},
+		user:        "alice",
+		pool:        "research",
+		provider:    taskProxyAnnotationProvider,
+	}
+
+	// the same way as rows are read from services table
+	data, err := yson.Marshal(makeTaskRow("00000001", task, "example.net", true))
+	require.NoError(t, err)
+	var row TaskRow
+	require.NoError(t, yson.Unmarshal(data, &row))
+	assert.Equal(t, "https://00000001.example.net", row.URL)
+	assert.Equal(t, []string{"node1:8080", "node2:8081"}, row.Endpoints)
+
+	restored, err := row.task("")
+	require.NoError(t, err)
+	assert.Equal(t, task.IDWithHostPort(), restored.IDWithHostPort())
+	assert.Equal(t, string(ca), task.options.upstreamTLS.ca)
+	assert.Equal(t, task.options, restored.options)
+	assert.Equal(t, task.jobs, restored.jobs)
+}
+
+func TestTaskRowRoundTripWithoutJobs(t *testing.T) {
+	// discovery makes empty slices for task without running jobs
+	task := Task{
+		operationID: "op1",
+		taskName:    "driver",
+		service:     "ui",
+		protocol:    HTTP,
+		jobs:        []HostPort{},
+		jobIDs:      []string{},
+		rawOptions:  map[string]any{},
+	}
+	seen := schema.Timestamp(1_000_000_000_000_000)
+	row := makeTaskRow("00000001", task, "example.net", false)
+	row.FirstSeen, row.LastSeen = seen, seen
+
+	data, err := yson.Marshal(row)
+	require.NoError(t, err)
+	var saved TaskRow
+	require.NoError(t, yson.Unmarshal(data, &saved))
+
+	// unchanged task is neither rewritten nor recorded as moved
+	rows := map[string]TaskRow{row.Hash: makeTaskRow("00000001", task, "example.net", false)}
+	assert.True(t, rows[row.Hash].sameTask(saved))
+	inserts, deletes := diffTaskRows(map[string]TaskRow{saved.Hash: saved}, rows, seen+1)
+	assert.Empty(t, inserts)
+	assert.Empty(t, deletes)
+	assert.Empty(t, diffTaskEvents(map[string]TaskRow{saved.Hash: saved}, rows, seen+1))
+}
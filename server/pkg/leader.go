@@ -0,0 +1,146 @@
+package pkg
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"go.ytsaurus.tech/yt/go/ypath"
+	"go.ytsaurus.tech/yt/go/yson"
+	ytsdk "go.ytsaurus.tech/yt/go/yt"
+	"go.ytsaurus.tech/yt/go/yterrors"
+)
+
+const (
+	leaderLockNodeName = "leader_lock"
+	// leader transaction is pinged by YT client, so it expires in this timeout after leader is gone
+	leaderTxTimeout = 30 * time.Second
+	// how often followers try to take the lock
+	leaderRetryPeriod = 10 * time.Second
+)
+
+// Leader election through exclusive Cypress lock taken in transaction under dir-path
+type leaderElection struct {
+	cluster  string
+	yt       ytsdk.Client
+	lockPath ypath.Path
+	// transaction holding the lock, nil if not leader
+	mx     sync.Mutex
+	tx     ytsdk.Tx
+	logger *Logger
+}
+
+func CreateLeaderElection(cluster string, dirPath string, yt ytsdk.Client, logger *Logger) *leaderElection {
+	return &leaderElection{
+		cluster:  cluster,
+		yt:       yt,
+		lockPath: ypath.Path(dirPath).Child(leaderLockNodeName),
+		logger:   logger.With("lock_path", dirPath+"/"+leaderLockNodeName),
+	}
+}
+
+// Whether the lock is held right now: transaction is checked directly, as expired one makes other server leader
+// before Run notices that
+func (e *leaderElection) IsLeader() bool {
+	_, ok := e.leaderTxID()
+	return ok
+}
+
+// Transaction holding the lock, writes of leader are made with it as prerequisite; false if not leader
+func (e *leaderElection) leaderTxID() (ytsdk.TxID, bool) {
+	e.mx.Lock()
+	tx := e.tx
+	e.mx.Unlock()
+	if tx == nil {
+		return ytsdk.TxID{}, false
+	}
+	select {
+	case <-tx.Finished():
+		return ytsdk.TxID{}, false
+	default:
+		return tx.ID(), true
+	}
+}
+
+// Takes leadership whenever lock is free, until ctx is done
+func (e *leaderElection) Run(ctx context.Context) {
+	for {
+		tx, err := e.acquire(ctx)
+		if err != nil {
+			if yterrors.ContainsErrorCode(err, yterrors.CodeConcurrentTransactionLockConflict) {
+				e.logger.Debug("leader lock is taken by other server")
+			} else {
+				e.logger.Warn("failed to take leader lock", "error", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(leaderRetryPeriod):
+				continue
+			}
+		}
+
+		e.setLeader(tx)
+		e.logger.Info("became leader", "tx_id", tx.ID().String())
+
+		select {
+		case <-tx.Finished():
+			e.setLeader(nil)
+			e.logger.Warn("lost leadership, leader transaction is finished", "tx_id", tx.ID().String())
+		case <-ctx.Done():
+			e.setLeader(nil)
+			_ = tx.Abort()
+			return
+		}
+	}
+}
+
+func (e *leaderElection) setLeader(tx ytsdk.Tx) {
+	e.mx.Lock()
+	e.tx = tx
+	e.mx.Unlock()
+	leadershipChanges.WithLabelValues(e.cluster).Inc()
+	if tx != nil {
+		leader.WithLabelValues(e.cluster).Set(1)
+	} else {
+		leader.WithLabelValues(e.cluster).Set(0)
+	}
+}
+
+func (e *leaderElection) acquire(ctx context.Context) (ytsdk.Tx, error) {
+	err := doYTRequest(ctx, "create_node", func(ctx context.Context) error {
+		_, err := e.yt.CreateNode(ctx, e.lockPath, ytsdk.NodeMap, &ytsdk.CreateNodeOptions{
+			Recursive:      true,
+			IgnoreExisting: true,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, _ := os.Hostname()
+	timeout := yson.Duration(leaderTxTimeout)
+	var tx ytsdk.Tx
+	err = doYTRequest(ctx, "start_tx", func(ctx context.Context) (err error) {
+		tx, err = e.yt.BeginTx(ctx, &ytsdk.StartTxOptions{
+			Timeout:    &timeout,
+			Attributes: map[string]any{"title": "task proxy leader " + hostname},
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = doYTRequest(ctx, "lock_node", func(ctx context.Context) error {
+		_, err := tx.LockNode(ctx, e.lockPath, ytsdk.LockExclusive, nil)
+		return err
+	})
+	if err != nil {
+		_ = tx.Abort()
+		return nil, err
+	}
+	return tx, nil
+}
@@ -0,0 +1,91 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	cachelog "github.com/envoyproxy/go-control-plane/pkg/log"
+)
+
+// Structured leveled logger with JSON output, level can be changed in runtime
+type Logger struct {
+	logger *slog.Logger
+	level  *slog.LevelVar
+}
+
+func CreateLogger(level slog.Level) *Logger {
+	return createLogger(os.Stderr, level)
+}
+
+func createLogger(w io.Writer, level slog.Level) *Logger {
+	levelVar := &slog.LevelVar{}
+	levelVar.Set(level)
+	return &Logger{
+		logger: slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: levelVar})),
+		level:  levelVar,
+	}
+}
+
+// Logger with fields added to every record, shares level with parent
+func (l *Logger) With(args ...any) *Logger {
+	return &Logger{
+		logger: l.logger.With(args...),
+		level:  l.level,
+	}
+}
+
+func (l *Logger) Level() slog.Level {
+	return l.level.Level()
+}
+
+func (l *Logger) SetLevel(level slog.Level) {
+	l.level.Set(level)
+}
+
+func (l *Logger) Debug(msg string, args ...any) {
+	l.logger.Debug(msg, args...)
+}
+
+func (l *Logger) Info(msg string, args ...any) {
+	l.logger.Info(msg, args...)
+}
+
+func (l *Logger) Warn(msg string, args ...any) {
+	l.logger.Warn(msg, args...)
+}
+
+func (l *Logger) Error(msg string, args ...any) {
+	l.logger.Error(msg, args...)
+}
+
+func (l *Logger) Fatal(msg string, args ...any) {
+	l.logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// Adapter for xDS snapshot cache, which logs with printf-style methods
+func (l *Logger) CacheLogger() cachelog.Logger {
+	return cacheLogger{logger: l.With("component", "xds_cache")}
+}
+
+type cacheLogger struct {
+	logger *Logger
+}
+
+func (l cacheLogger) Debugf(format string, args ...any) {
+	l.logger.Debug(fmt.Sprintf(format, args...))
+}
+
+func (l cacheLogger) Infof(format string, args ...any) {
+	l.logger.Info(fmt.Sprintf(format, args...))
+}
+
+func (l cacheLogger) Warnf(format string, args ...any) {
+	l.logger.Warn(fmt.Sprintf(format, args...))
+}
+
+func (l cacheLogger) Errorf(format string, args ...any) {
+	l.logger.Error(fmt.Sprintf(format, args...))
+}
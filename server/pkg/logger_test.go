@@ -0,0 +1,41 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func createTestLogger() *Logger {
+	return createLogger(io.Discard, slog.LevelDebug)
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := createLogger(&buf, slog.LevelInfo)
+	taskLogger := logger.With("operation_id", "op1")
+
+	taskLogger.Debug("hidden")
+	assert.Empty(t, buf.String())
+
+	logger.SetLevel(slog.LevelDebug)
+	taskLogger.Debug("checking auth", "hash", "00000001")
+
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	assert.Equal(t, "DEBUG", record["level"])
+	assert.Equal(t, "checking auth", record["msg"])
+	assert.Equal(t, "op1", record["operation_id"])
+	assert.Equal(t, "00000001", record["hash"])
+
+	buf.Reset()
+	logger.CacheLogger().Infof("respond %d resources", 3)
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	assert.Equal(t, "respond 3 resources", record["msg"])
+	assert.Equal(t, "xds_cache", record["component"])
+}
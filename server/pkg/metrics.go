@@ -0,0 +1,136 @@
+package pkg
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "task_proxy"
+
+const (
+	outcomeSuccess = "success"
+	outcomeError   = "error"
+)
+
+var (
+	discoveryCycleDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "discovery_cycle_duration_seconds",
+		Help:      "Duration of full discovery cycle over all running operations.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+	}, []string{"outcome"})
+	discoveryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "discovery_operation_duration_seconds",
+		Help:      "Duration of tasks discovery in one operation by discovery provider.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"provider", "outcome"})
+	discoveredOperations = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "discovered_operations",
+		Help:      "Number of running operations found in last discovery cycle.",
+	})
+	discoveredTasks = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "discovered_tasks",
+		Help:      "Number of task services found in last discovery cycle.",
+	})
+	discoveredJobs = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "discovered_jobs",
+		Help:      "Number of task service endpoints in jobs found in last discovery cycle.",
+	})
+	discoveryFailing = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "discovery_failing",
+		Help:      "1 if last discovery of cluster failed or its leader doesn't refresh services table, 0 otherwise.",
+	}, []string{"cluster"})
+	lastDiscoverySuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_discovery_success_timestamp_seconds",
+		Help:      "Unix time of last successful discovery of cluster.",
+	}, []string{"cluster"})
+
+	ytRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "yt_request_duration_seconds",
+		Help:      "Latency of YT API requests by method.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"method"})
+	ytRequestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "yt_request_errors_total",
+		Help:      "Number of failed YT API requests by method.",
+	}, []string{"method"})
+
+	snapshotVersionChanges = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "snapshot_version_changes_total",
+		Help:      "Number of xDS snapshots set with new version.",
+	})
+	tableWrites = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "services_table_writes_total",
+		Help:      "Number of services table writes by outcome.",
+	}, []string{"outcome"})
+
+	leader = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "leader",
+		Help:      "1 if server is leader doing discovery and services table writes of cluster, 0 otherwise.",
+	}, []string{"cluster"})
+	leadershipChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "leadership_changes_total",
+		Help:      "Number of times server became leader of cluster or lost leadership.",
+	}, []string{"cluster"})
+
+	ytTokenReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "yt_token_reloads_total",
+		Help:      "Number of YT token file changes by outcome, error if changed file could not be read.",
+	}, []string{"outcome"})
+
+	certificateReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "certificate_reloads_total",
+		Help:      "Number of TLS certificate changes by outcome, error if changed files are invalid or not applied.",
+	}, []string{"outcome"})
+
+	authDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "auth_decisions_total",
+		Help:      "Number of ext_authz decisions by result and reason.",
+	}, []string{"result", "reason"})
+	authCheckDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "auth_check_duration_seconds",
+		Help:      "Latency of ext_authz checks by result.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 12),
+	}, []string{"result"})
+)
+
+func outcome(err error) string {
+	if err != nil {
+		return outcomeError
+	}
+	return outcomeSuccess
+}
+
+func observeYTRequest(method string, start time.Time, err error) {
+	ytRequestDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		ytRequestErrors.WithLabelValues(method).Inc()
+	}
+}
+
+func observeAuthDecision(allowed bool, reason string, start time.Time) {
+	result := "denied"
+	if allowed {
+		result = "allowed"
+	}
+	authDecisions.WithLabelValues(result, reason).Inc()
+	authCheckDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+}
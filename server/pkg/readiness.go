@@ -0,0 +1,169 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracks server state for liveness and readiness probes
+type readiness struct {
+	mx          sync.RWMutex
+	grpcServing bool
+	snapshotSet bool
+	// discovery state by cluster name; failing cluster doesn't make server not ready while other ones are fine,
+	// as all clusters are served by the same replicas
+	discoveries        map[string]*discoveryState
+	stalenessThreshold time.Duration
+}
+
+type discoveryState struct {
+	succeeded bool
+	// tasks saved in services table are served until the first discovery
+	savedApplied bool
+	failingSince time.Time
+	err          error
+}
+
+func CreateReadiness(stalenessThreshold time.Duration) *readiness {
+	return &readiness{
+		discoveries:        make(map[string]*discoveryState),
+		stalenessThreshold: stalenessThreshold,
+	}
+}
+
+// Registers cluster, it is not healthy until its discovery succeeds or saved tasks are applied
+func (r *readiness) AddCluster(cluster string) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	r.getDiscovery(cluster)
+}
+
+func (r *readiness) getDiscovery(cluster string) *discoveryState {
+	state, ok := r.discoveries[cluster]
+	if !ok {
+		state = &discoveryState{}
+		r.discoveries[cluster] = state
+	}
+	return state
+}
+
+func (r *readiness) SetGRPCServing() {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	r.grpcServing = true
+}
+
+func (r *readiness) SetSnapshotSet() {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	r.snapshotSet = true
+}
+
+func (r *readiness) SavedApplied(cluster string) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	r.getDiscovery(cluster).savedApplied = true
+}
+
+func (r *readiness) DiscoverySucceeded(cluster string) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	state := r.getDiscovery(cluster)
+	state.succeeded = true
+	state.failingSince, state.err = time.Time{}, nil
+	discoveryFailing.WithLabelValues(cluster).Set(0)
+	lastDiscoverySuccess.WithLabelValues(cluster).SetToCurrentTime()
+}
+
+func (r *readiness) DiscoveryFailed(cluster string, err error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	state := r.getDiscovery(cluster)
+	if state.failingSince.IsZero() {
+		state.failingSince = time.Now()
+	}
+	state.err = err
+	discoveryFailing.WithLabelValues(cluster).Set(1)
+}
+
+// Process is alive and gRPC server is up
+func (r *readiness) alive() error {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	if !r.grpcServing {
+		return fmt.Errorf("gRPC server is not serving")
+	}
+	return nil
+}
+
+// Snapshot is set, and any cluster is discovered or all of them serve saved tasks, while discovery
+// is not failing for too long
+func (r *readiness) ready() error {
+	if err := r.alive(); err != nil {
+		return err
+	}
+
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	if len(r.discoveries) == 0 {
+		return fmt.Errorf("no successful discovery yet")
+	}
+	if !r.snapshotSet {
+		return fmt.Errorf("no snapshot set yet")
+	}
+
+	allSavedApplied := true
+	var problems []string
+	for _, cluster := range slices.Sorted(maps.Keys(r.discoveries)) {
+		state := r.discoveries[cluster]
+		if failing := time.Since(state.failingSince); !state.failingSince.IsZero() && failing > r.stalenessThreshold {
+			problems = append(problems, fmt.Sprintf("discovery of cluster %q is failing for %s", cluster, failing.Round(time.Second)))
+			allSavedApplied = false
+			continue
+		}
+		if state.succeeded {
+			return nil
+		}
+		if !state.savedApplied {
+			allSavedApplied = false
+		}
+		problems = append(problems, fmt.Sprintf("no successful discovery of cluster %q yet", cluster))
+	}
+	if allSavedApplied {
+		return nil
+	}
+	return errors.New(strings.Join(problems, "; "))
+}
+
+// Clusters whose discovery is failing now, for admin API
+func (r *readiness) discoveryErrors() []OperationError {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	var errs []OperationError
+	for _, cluster := range slices.Sorted(maps.Keys(r.discoveries)) {
+		state := r.discoveries[cluster]
+		if state.failingSince.IsZero() {
+			continue
+		}
+		errs = append(errs, OperationError{
+			Cluster: cluster,
+			Error:   fmt.Sprintf("discovery is failing: %v", state.err),
+			Time:    state.failingSince,
+		})
+	}
+	return errs
+}
@@ -0,0 +1,74 @@
+package pkg
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadiness(t *testing.T) {
+	r := CreateReadiness(time.Minute)
+	assert.Error(t, r.alive())
+	assert.Error(t, r.ready())
+
+	r.SetGRPCServing()
+	assert.NoError(t, r.alive())
+	assert.Error(t, r.ready())
+
+	r.DiscoveryFailed("", errors.New("timeout"))
+	r.DiscoverySucceeded("")
+	assert.Error(t, r.ready())
+
+	r.SetSnapshotSet()
+	assert.NoError(t, r.ready())
+
+	r.DiscoveryFailed("", errors.New("timeout"))
+	assert.NoError(t, r.ready())
+
+	r.discoveries[""].failingSince = time.Now().Add(-2 * time.Minute)
+	assert.Error(t, r.ready())
+	assert.NoError(t, r.alive())
+
+	r.DiscoverySucceeded("")
+	assert.NoError(t, r.ready())
+}
+
+func TestReadinessClusters(t *testing.T) {
+	r := CreateReadiness(time.Minute)
+	r.SetGRPCServing()
+	r.SetSnapshotSet()
+	r.AddCluster("hahn")
+	r.AddCluster("arnold")
+	assert.ErrorContains(t, r.ready(), `no successful discovery of cluster "arnold" yet`)
+
+	// saved tasks are served until the first discovery, if they are loaded for every cluster
+	r.SavedApplied("hahn")
+	assert.Error(t, r.ready())
+	r.SavedApplied("arnold")
+	assert.NoError(t, r.ready())
+
+	r.DiscoverySucceeded("hahn")
+	r.DiscoverySucceeded("arnold")
+	assert.NoError(t, r.ready())
+	assert.Empty(t, r.discoveryErrors())
+
+	// failing cluster doesn't take healthy one out of service, but it is reported
+	r.DiscoveryFailed("arnold", errors.New("proxy is unavailable"))
+	r.discoveries["arnold"].failingSince = time.Now().Add(-2 * time.Minute)
+	assert.NoError(t, r.ready())
+	errs := r.discoveryErrors()
+	require.Len(t, errs, 1)
+	assert.Equal(t, "arnold", errs[0].Cluster)
+	assert.Equal(t, "discovery is failing: proxy is unavailable", errs[0].Error)
+
+	r.DiscoveryFailed("hahn", errors.New("proxy is unavailable"))
+	r.discoveries["hahn"].failingSince = time.Now().Add(-2 * time.Minute)
+	assert.ErrorContains(t, r.ready(), `discovery of cluster "arnold" is failing`)
+	assert.ErrorContains(t, r.ready(), `discovery of cluster "hahn" is failing`)
+
+	r.DiscoverySucceeded("hahn")
+	assert.NoError(t, r.ready())
+}
@@ -0,0 +1,261 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+
+	bootstrapv3 "github.com/envoyproxy/go-control-plane/envoy/config/bootstrap/v3"
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	listenerv3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	resourcev3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"go.ytsaurus.tech/yt/go/guid"
+	"go.ytsaurus.tech/yt/go/ypath"
+	"go.ytsaurus.tech/yt/go/yson"
+	ytsdk "go.ytsaurus.tech/yt/go/yt"
+	"go.ytsaurus.tech/yt/go/yterrors"
+	"google.golang.org/protobuf/encoding/protojson"
+	"gopkg.in/yaml.v3"
+)
+
+// certificate directory of Envoy container in chart, for rendered config with TLS
+const renderCertificateDir = "/etc/certs"
+
+// Cluster state for offline rendering: running operations, their jobs and Cypress nodes read by discovery
+type renderFixture struct {
+	Operations []ytsdk.OperationStatus `yson:"operations"`
+	// running jobs by operation ID
+	Jobs map[string][]fixtureJob `yson:"jobs"`
+	// Cypress node values by path, e.g. SPYT discovery directories
+	Nodes map[string]any `yson:"nodes"`
+}
+
+type fixtureJob struct {
+	ID       string `yson:"id"`
+	Address  string `yson:"address"`
+	TaskName string `yson:"task_name"`
+	JobPorts []int  `yson:"job_ports"`
+}
+
+// Reads YSON fixture, or JSON one if file has .json extension
+func loadRenderFixture(path string) (*renderFixture, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Ext(path) == ".json" {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		var value any
+		if err := decoder.Decode(&value); err != nil {
+			return nil, fmt.Errorf("invalid JSON fixture: %v", err)
+		}
+		if data, err = yson.Marshal(jsonToYSON(value)); err != nil {
+			return nil, err
+		}
+	}
+	var fixture renderFixture
+	if err := yson.Unmarshal(data, &fixture); err != nil {
+		return nil, fmt.Errorf("invalid fixture: %v", err)
+	}
+	return &fixture, nil
+}
+
+// JSON numbers are integers for YSON when they have no fraction, as ports and counts in annotations
+func jsonToYSON(value any) any {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		for key, item := range v {
+			v[key] = jsonToYSON(item)
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = jsonToYSON(item)
+		}
+	}
+	return value
+}
+
+// In-memory YT stand-in serving requests of discovery providers from fixture
+type fixtureYT struct {
+	ytsdk.Client
+
+	fixture *renderFixture
+	nodes   map[string]any
+}
+
+func createFixtureYT(fixture *renderFixture) (*fixtureYT, error) {
+	nodes := make(map[string]any)
+	for path, value := range fixture.Nodes {
+		nodes[path] = value
+	}
+	for _, jobs := range fixture.Jobs {
+		for _, job := range jobs {
+			if _, err := guid.ParseString(job.ID); err != nil {
+				return nil, fmt.Errorf("invalid job ID %q: %v", job.ID, err)
+			}
+			nodes[jobPortsPath(job.Address, job.ID)] = job.JobPorts
+		}
+	}
+	return &fixtureYT{fixture: fixture, nodes: nodes}, nil
+}
+
+func jobPortsPath(address, jobID string) string {
+	return fmt.Sprintf("//sys/exec_nodes/%s/orchid/exec_node/job_controller/active_jobs/%s/job_ports", address, jobID)
+}
+
+func (y *fixtureYT) ListOperations(
+	_ context.Context,
+	options *ytsdk.ListOperationsOptions,
+) (*ytsdk.ListOperationsResult, error) {
+	// all operations fit into the first page
+	if options != nil && options.Cursor != nil {
+		return &ytsdk.ListOperationsResult{}, nil
+	}
+	return &ytsdk.ListOperationsResult{Operations: y.fixture.Operations}, nil
+}
+
+func (y *fixtureYT) ListJobs(
+	_ context.Context,
+	opID ytsdk.OperationID,
+	_ *ytsdk.ListJobsOptions,
+) (*ytsdk.ListJobsResult, error) {
+	result := &ytsdk.ListJobsResult{}
+	for _, job := range y.fixture.Jobs[opID.String()] {
+		jobID, _ := guid.ParseString(job.ID)
+		result.Jobs = append(result.Jobs, ytsdk.JobStatus{
+			ID:       ytsdk.JobID(jobID),
+			Address:  job.Address,
+			TaskName: job.TaskName,
+			State:    string(ytsdk.JobRunning),
+		})
+	}
+	return result, nil
+}
+
+func (y *fixtureYT) GetNode(_ context.Context, path ypath.YPath, result any, _ *ytsdk.GetNodeOptions) error {
+	value, err := y.getNode(path)
+	if err != nil {
+		return err
+	}
+	data, err := yson.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return yson.Unmarshal(data, result)
+}
+
+// Lists children of map node or items of list node
+func (y *fixtureYT) ListNode(ctx context.Context, path ypath.YPath, result any, _ *ytsdk.ListNodeOptions) error {
+	value, err := y.getNode(path)
+	if err != nil {
+		return err
+	}
+	if children, ok := value.(map[string]any); ok {
+		value = slices.Sorted(maps.Keys(children))
+	}
+	data, err := yson.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return yson.Unmarshal(data, result)
+}
+
+func (y *fixtureYT) getNode(path ypath.YPath) (any, error) {
+	value, ok := y.nodes[path.YPath().String()]
+	if !ok {
+		return nil, yterrors.Err(yterrors.CodeResolveError, fmt.Sprintf("node %v has no child", path))
+	}
+	return value, nil
+}
+
+// Runs discovery over fixture and writes Envoy bootstrap with snapshot listeners and clusters as static resources,
+// so output can be checked with 'envoy --mode validate'
+func renderSnapshot(ctx context.Context, fixture *renderFixture, config SnapshotConfig, w io.Writer) error {
+	yt, err := createFixtureYT(fixture)
+	if err != nil {
+		return err
+	}
+	d := CreateTaskDiscovery("", config.BaseDomain, "//tmp", 0, yt, createLogger(os.Stderr, slog.LevelWarn))
+	tasks, err := d.discovery(ctx)
+	if err != nil {
+		return err
+	}
+	if errs := d.getOperationErrors(); len(errs) > 0 {
+		return fmt.Errorf("failed to process operation %s: %s", errs[0].OperationID, errs[0].Error)
+	}
+
+	hashToTask, version := MakeHashToTask(tasks)
+	snapshot, err := makeSnapshot(hashToTask, version, config)
+	if err != nil {
+		return err
+	}
+
+	bootstrap := &bootstrapv3.Bootstrap{StaticResources: &bootstrapv3.Bootstrap_StaticResources{}}
+	listeners := snapshot.GetResources(resourcev3.ListenerType)
+	for _, name := range slices.Sorted(maps.Keys(listeners)) {
+		bootstrap.StaticResources.Listeners = append(bootstrap.StaticResources.Listeners, listeners[name].(*listenerv3.Listener))
+	}
+	clusters := snapshot.GetResources(resourcev3.ClusterType)
+	for _, name := range slices.Sorted(maps.Keys(clusters)) {
+		bootstrap.StaticResources.Clusters = append(bootstrap.StaticResources.Clusters, clusters[name].(*clusterv3.Cluster))
+	}
+	// there is no ADS without control plane, so certificates are static secrets
+	for _, certificate := range config.Certificates {
+		bootstrap.StaticResources.Secrets = append(bootstrap.StaticResources.Secrets, certificate.secret)
+	}
+	for _, listener := range bootstrap.StaticResources.Listeners {
+		if err := useStaticSecrets(listener); err != nil {
+			return err
+		}
+	}
+
+	// protojson output is not stable, so it goes through YAML encoder with sorted keys
+	data, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(bootstrap)
+	if err != nil {
+		return err
+	}
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(value); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// SDS secrets without config source are looked up in static resources
+func useStaticSecrets(listener *listenerv3.Listener) error {
+	for _, filterChain := range listener.FilterChains {
+		if filterChain.TransportSocket == nil {
+			continue
+		}
+		var tlsContext tlsv3.DownstreamTlsContext
+		if err := filterChain.TransportSocket.GetTypedConfig().UnmarshalTo(&tlsContext); err != nil {
+			return err
+		}
+		for _, sdsConfig := range tlsContext.GetCommonTlsContext().GetTlsCertificateSdsSecretConfigs() {
+			sdsConfig.SdsConfig = nil
+		}
+		filterChain.TransportSocket.ConfigType = &corev3.TransportSocket_TypedConfig{TypedConfig: mustAny(&tlsContext)}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files in testdata")
+
+func TestRenderSnapshotGolden(t *testing.T) {
+	fixture, err := loadRenderFixture("testdata/render/operations.yson")
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	require.NoError(t, renderSnapshot(context.Background(), fixture, testSnapshotConfig, &out))
+
+	goldenPath := "testdata/render/envoy.yaml"
+	if *updateGolden {
+		require.NoError(t, os.WriteFile(goldenPath, out.Bytes(), 0o644))
+	}
+	golden, err := os.ReadFile(goldenPath)
+	require.NoError(t, err)
+	assert.Equal(t, string(golden), out.String())
+}
+
+func TestLoadRenderFixtureJSON(t *testing.T) {
+	fixture, err := loadRenderFixture("testdata/render/operations.json")
+	require.NoError(t, err)
+	require.Len(t, fixture.Operations, 1)
+	assert.Equal(t, "9-a-b-c", fixture.Operations[0].ID.String())
+	assert.Equal(t, []int{20001, 20002}, fixture.Jobs["9-a-b-c"][0].JobPorts)
+
+	yt, err := createFixtureYT(fixture)
+	require.NoError(t, err)
+	d := CreateTaskDiscovery("", "example.net", "//tmp", 0, yt, createTestLogger())
+	tasks, err := d.discovery(context.Background())
+	require.NoError(t, err)
+	require.Len(t, tasks, 2)
+
+	hashToTask, _ := MakeHashToTask(tasks)
+	task := hashToTask[Hash([]byte("9-a-b-cserverui"))]
+	assert.Equal(t, []HostPort{{host: "node2.example.net", port: 20002}}, task.jobs)
+	assert.Equal(t, optionalOf(1500*time.Millisecond), task.options.timeout)
+}
@@ -1,9 +1,18 @@
 package pkg
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"fmt"
+	"log/slog"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+
+	"go.ytsaurus.tech/yt/go/schema"
 )
 
 type Protocol string
@@ -18,20 +27,124 @@ type HostPort struct {
 	port uint32
 }
 
+// TLS settings for connections from proxy to service inside job; certificate is verified with system CA bundle,
+// or with PEM CA passed inline, as operations can't refer to files of proxy container
+type upstreamTLSOptions struct {
+	enabled    bool
+	sni        string
+	ca         string
+	skipVerify bool
+}
+
+type healthCheckType string
+
+const (
+	httpHealthCheck healthCheckType = "http"
+	grpcHealthCheck healthCheckType = "grpc"
+	tcpHealthCheck  healthCheckType = "tcp"
+)
+
+// Active health checking of service endpoints in jobs
+type healthCheckOptions struct {
+	enabled bool
+	kind    healthCheckType
+	// HTTP path for http check
+	path string
+	// gRPC health service name for grpc check, empty checks the whole server
+	serviceName        string
+	interval           time.Duration
+	timeout            time.Duration
+	healthyThreshold   uint32
+	unhealthyThreshold uint32
+}
+
+type stickyLbPolicy string
+
+const (
+	ringHashLbPolicy stickyLbPolicy = "ring_hash"
+	maglevLbPolicy   stickyLbPolicy = "maglev"
+)
+
+// Session affinity to one job by consistent hashing of cookie or header
+type stickyOptions struct {
+	enabled  bool
+	lbPolicy stickyLbPolicy
+	// hash by header value if set, by cookie otherwise
+	header     string
+	cookieName string
+	cookieTTL  optional[time.Duration]
+}
+
+// Annotation value which overrides global default when set
+type optional[T any] struct {
+	value T
+	set   bool
+}
+
+func optionalOf[T any](value T) optional[T] {
+	return optional[T]{value: value, set: true}
+}
+
+func (o optional[T]) getOr(defaultValue T) T {
+	if o.set {
+		return o.value
+	}
+	return defaultValue
+}
+
+// Per-service options from task_proxy annotation
+type serviceOptions struct {
+	websocket bool
+	// gRPC-Web translation for browser clients, applies to gRPC services only
+	grpcWeb     bool
+	upstreamTLS upstreamTLSOptions
+	healthCheck healthCheckOptions
+	// route timeouts, zero disables timeout
+	timeout     optional[time.Duration]
+	idleTimeout optional[time.Duration]
+	retryOn     optional[string]
+	numRetries  optional[uint32]
+	sticky      stickyOptions
+}
+
 type Task struct {
+	// name of YT cluster running operation, empty for single cluster server
+	cluster     string
 	operationID string
 	taskName    string
 	service     string
 	protocol    Protocol
 	jobs        []HostPort
+	options     serviceOptions
+	// service info from task_proxy annotation, stored in services table to restore options
+	rawOptions map[string]any
+	// known for jobs of annotated operations only, in the same order as jobs
+	jobIDs []string
+	// operation details for services table
+	user     string
+	pool     string
+	provider string
 }
 
 // Identifies task, for sorting and domain hash
 func (t *Task) ID() string {
-	return t.operationID + t.taskName + t.service
+	id := t.operationID + t.taskName + t.service
+	if t.cluster != "" {
+		id = t.cluster + "/" + id
+	}
+	return id
+}
+
+// Domains of cluster tasks are namespaced by cluster name, <hash>.<cluster>.<base domain>
+func (t *Task) domain(hash, baseDomain string) string {
+	if t.cluster != "" {
+		baseDomain = t.cluster + "." + baseDomain
+	}
+	return getTaskDomain(hash, baseDomain)
 }
 
-// ID with jobs (host, port)-s to create correct version for xDS data (jobs can move between hosts)
+// ID with jobs (host, port)-s to create correct version for xDS data (jobs can move between hosts),
+// options are included too, as annotation can be changed in runtime parameters
 func (t *Task) IDWithHostPort() string {
 	sb := strings.Builder{}
 	sb.WriteString(t.ID())
@@ -39,15 +152,169 @@ func (t *Task) IDWithHostPort() string {
 		sb.WriteString(job.host)
 		fmt.Fprintf(&sb, "%d", job.port)
 	}
+	fmt.Fprintf(&sb, "%+v", t.options)
+	// job restarted on the same host:port is a new row in services table
+	for _, jobID := range t.jobIDs {
+		sb.WriteString(jobID)
+	}
 	return sb.String()
 }
 
+// Row of services sorted dynamic table, keyed by task hash;
+// columns added later are optional, so existing table can be altered
 type TaskRow struct {
-	OperationID string `yson:"operation_id"`
-	TaskName    string `yson:"task_name"`
-	Service     string `yson:"service"`
-	Protocol    string `yson:"protocol"`
-	Domain      string `yson:"domain"`
+	Hash        string           `yson:"hash,key"`
+	OperationID string           `yson:"operation_id"`
+	TaskName    string           `yson:"task_name"`
+	Service     string           `yson:"service"`
+	Protocol    string           `yson:"protocol"`
+	Domain      string           `yson:"domain"`
+	URL         string           `yson:"url,omitempty"`
+	JobIDs      []string         `yson:"job_ids,omitempty"`
+	Endpoints   []string         `yson:"endpoints,omitempty"`
+	User        string           `yson:"user,omitempty"`
+	Pool        string           `yson:"pool,omitempty"`
+	Provider    string           `yson:"provider,omitempty"`
+	FirstSeen   schema.Timestamp `yson:"first_seen,omitempty"`
+	LastSeen    schema.Timestamp `yson:"last_seen,omitempty"`
+	Options     map[string]any   `yson:"options,omitempty"`
+}
+
+// Rows are equal except for seen timestamps
+func (r TaskRow) sameTask(other TaskRow) bool {
+	r.FirstSeen, r.LastSeen = 0, 0
+	other.FirstSeen, other.LastSeen = 0, 0
+	return reflect.DeepEqual(r, other)
+}
+
+// Task lifecycle events of history table
+const (
+	taskAppeared    = "appeared"
+	taskMoved       = "moved"
+	taskDisappeared = "disappeared"
+)
+
+// Row of append-only history sorted dynamic table, keyed by event time and task hash
+type TaskEventRow struct {
+	Time        schema.Timestamp `yson:"time,key"`
+	Hash        string           `yson:"hash,key"`
+	Event       string           `yson:"event"`
+	OperationID string           `yson:"operation_id"`
+	TaskName    string           `yson:"task_name"`
+	Service     string           `yson:"service"`
+	Domain      string           `yson:"domain"`
+	JobIDs      []string         `yson:"job_ids,omitempty"`
+	Endpoints   []string         `yson:"endpoints,omitempty"`
+}
+
+func makeTaskEventRow(now schema.Timestamp, event string, row TaskRow) TaskEventRow {
+	return TaskEventRow{
+		Time:        now,
+		Hash:        row.Hash,
+		Event:       event,
+		OperationID: row.OperationID,
+		TaskName:    row.TaskName,
+		Service:     row.Service,
+		Domain:      row.Domain,
+		JobIDs:      row.JobIDs,
+		Endpoints:   row.Endpoints,
+	}
+}
+
+type taskRowKey struct {
+	Hash string `yson:"hash"`
+}
+
+func makeTaskRow(hash string, task Task, baseDomain string, tls bool) TaskRow {
+	domain := task.domain(hash, baseDomain)
+	scheme := "http"
+	if tls {
+		scheme = "https"
+	}
+	row := TaskRow{
+		Hash:        hash,
+		OperationID: task.operationID,
+		TaskName:    task.taskName,
+		Service:     task.service,
+		Protocol:    string(task.protocol),
+		Domain:      domain,
+		URL:         scheme + "://" + domain,
+		JobIDs:      task.jobIDs,
+		Endpoints:   task.endpoints(),
+		User:        task.user,
+		Pool:        task.pool,
+		Provider:    task.provider,
+		Options:     task.rawOptions,
+	}
+	// omitempty columns are read back as nil, so empty ones are nil for row to be the same as saved one
+	if len(row.JobIDs) == 0 {
+		row.JobIDs = nil
+	}
+	if len(row.Endpoints) == 0 {
+		row.Endpoints = nil
+	}
+	if len(row.Options) == 0 {
+		row.Options = nil
+	}
+	return row
+}
+
+func (t *Task) endpoints() []string {
+	endpoints := make([]string, 0, len(t.jobs))
+	for _, job := range t.jobs {
+		endpoints = append(endpoints, net.JoinHostPort(job.host, strconv.Itoa(int(job.port))))
+	}
+	return endpoints
+}
+
+// Task restored from row, the same as discovered one
+func (r *TaskRow) task(cluster string) (Task, error) {
+	task := Task{
+		cluster:     cluster,
+		operationID: r.OperationID,
+		taskName:    r.TaskName,
+		service:     r.Service,
+		protocol:    Protocol(r.Protocol),
+		options:     parseServiceOptions(r.Options, Protocol(r.Protocol)),
+		rawOptions:  r.Options,
+		jobIDs:      r.JobIDs,
+		user:        r.User,
+		pool:        r.Pool,
+		provider:    r.Provider,
+	}
+	for _, endpoint := range r.Endpoints {
+		hostPort, err := makeHostPortFromNode(endpoint)
+		if err != nil {
+			return Task{}, fmt.Errorf("invalid endpoint of task %q: %v", r.Hash, err)
+		}
+		task.jobs = append(task.jobs, *hostPort)
+	}
+	return task, nil
+}
+
+// Task view for admin API
+type TaskInfo struct {
+	Hash        string   `json:"hash"`
+	Domain      string   `json:"domain"`
+	Cluster     string   `json:"cluster,omitempty"`
+	OperationID string   `json:"operation_id"`
+	TaskName    string   `json:"task_name"`
+	Service     string   `json:"service"`
+	Protocol    string   `json:"protocol"`
+	Jobs        []string `json:"jobs"`
+}
+
+func makeTaskInfo(hash string, task Task, baseDomain string) TaskInfo {
+	return TaskInfo{
+		Hash:        hash,
+		Domain:      task.domain(hash, baseDomain),
+		Cluster:     task.cluster,
+		OperationID: task.operationID,
+		TaskName:    task.taskName,
+		Service:     task.service,
+		Protocol:    string(task.protocol),
+		Jobs:        task.endpoints(),
+	}
 }
 
 func getTaskDomain(taskHash, baseDomain string) string {
@@ -61,10 +328,45 @@ func Hash(source []byte) string {
 
 type TaskList []Task
 
+// Tasks by hash of ID and version of discovered state
+func MakeHashToTask(tasks TaskList) (map[string]Task, string) {
+	sort.Sort(tasks)
+	hashToTask := make(map[string]Task)
+	var buf bytes.Buffer
+	for _, task := range tasks {
+		buf.Write([]byte(task.IDWithHostPort()))
+		hashToTask[Hash([]byte(task.ID()))] = task
+	}
+	return hashToTask, Hash(buf.Bytes())
+}
+
 func (a TaskList) Len() int           { return len(a) }
 func (a TaskList) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a TaskList) Less(i, j int) bool { return a[i].ID() < a[j].ID() }
 
+// Short task description for logs: operation, task, service, protocol and jobs
+func (t Task) String() string {
+	sb := strings.Builder{}
+	fmt.Fprintf(&sb, "%s/%s/%s (%s)", t.operationID, t.taskName, t.service, t.protocol)
+	for i, job := range t.jobs {
+		if i == 0 {
+			sb.WriteString(" ")
+		} else {
+			sb.WriteString(",")
+		}
+		fmt.Fprintf(&sb, "%s:%d", job.host, job.port)
+	}
+	return sb.String()
+}
+
+func (a TaskList) LogValue() slog.Value {
+	tasks := make([]string, 0, len(a))
+	for _, task := range a {
+		tasks = append(tasks, task.String())
+	}
+	return slog.AnyValue(tasks)
+}
+
 func (a TaskList) String() string {
 	sb := strings.Builder{}
 	for _, task := range a {
@@ -0,0 +1,85 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.ytsaurus.tech/yt/go/proto/core/rpc"
+	ytsdk "go.ytsaurus.tech/yt/go/yt"
+)
+
+// Kubernetes updates mounted secrets in a minute or so, token is re-read more often
+const ytTokenReloadPeriod = 30 * time.Second
+
+// YT token credentials read from file, the file is watched so rotated secret is used without restart;
+// all clients created with it switch to new token at once
+type ytTokenFile struct {
+	path   string
+	token  atomic.Pointer[ytsdk.TokenCredentials]
+	logger *Logger
+}
+
+func LoadYTTokenFile(path string, logger *Logger) (*ytTokenFile, error) {
+	f := &ytTokenFile{path: path, logger: logger.With("path", path)}
+	token, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	f.token.Store(&ytsdk.TokenCredentials{Token: token})
+	return f, nil
+}
+
+func (f *ytTokenFile) Set(r *http.Request) {
+	f.token.Load().Set(r)
+}
+
+func (f *ytTokenFile) SetExtension(req *rpc.TRequestHeader) {
+	f.token.Load().SetExtension(req)
+}
+
+// Re-reads token file until ctx is done
+func (f *ytTokenFile) Watch(ctx context.Context) {
+	ticker := time.NewTicker(ytTokenReloadPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			f.reload()
+		}
+	}
+}
+
+// Swaps token if file content changed; old token is kept if file can't be read, e.g. in the middle of update
+func (f *ytTokenFile) reload() {
+	token, err := f.read()
+	if err != nil {
+		f.logger.Error("failed to reload YT token, old one is used", "error", err)
+		ytTokenReloads.WithLabelValues(outcome(err)).Inc()
+		return
+	}
+	if token == f.token.Load().Token {
+		return
+	}
+	f.token.Store(&ytsdk.TokenCredentials{Token: token})
+	f.logger.Info("YT token is rotated")
+	ytTokenReloads.WithLabelValues(outcomeSuccess).Inc()
+}
+
+func (f *ytTokenFile) read() (string, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", errors.New("YT token file is empty")
+	}
+	return token, nil
+}
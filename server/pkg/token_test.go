@@ -0,0 +1,47 @@
+package pkg
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestYTTokenFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(path, []byte("token1\n"), 0o600))
+
+	tokenFile, err := LoadYTTokenFile(path, createTestLogger())
+	require.NoError(t, err)
+
+	authorization := func() string {
+		r, _ := http.NewRequest(http.MethodGet, "http://yt", nil)
+		tokenFile.Set(r)
+		return r.Header.Get("Authorization")
+	}
+	assert.Equal(t, "OAuth token1", authorization())
+
+	rotations := ytTokenReloads.WithLabelValues(outcomeSuccess)
+	before := testutil.ToFloat64(rotations)
+
+	// unchanged file is not a rotation
+	tokenFile.reload()
+	assert.Equal(t, before, testutil.ToFloat64(rotations))
+
+	require.NoError(t, os.WriteFile(path, []byte("token2\n"), 0o600))
+	tokenFile.reload()
+	assert.Equal(t, "OAuth token2", authorization())
+	assert.Equal(t, before+1, testutil.ToFloat64(rotations))
+
+	// token is kept while file is being replaced
+	require.NoError(t, os.WriteFile(path, nil, 0o600))
+	tokenFile.reload()
+	assert.Equal(t, "OAuth token2", authorization())
+
+	_, err = LoadYTTokenFile(filepath.Join(t.TempDir(), "missing"), createTestLogger())
+	assert.Error(t, err)
+}
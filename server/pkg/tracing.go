@@ -0,0 +1,87 @@
+package pkg
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+)
+
+const tracingServiceName = "task-proxy-server"
+
+// Uses global tracer provider, which is no-op unless tracing is initialized
+var tracer = otel.Tracer("github.com/ytsaurus/ytsaurus-task-proxy/pkg")
+
+// Exports spans to OTLP gRPC collector, returns shutdown function flushing remaining spans
+func InitTracing(ctx context.Context, otlpEndpoint string, samplingPercent float64) (func(context.Context) error, error) {
+	exporter, err := otlptracegrpc.New(
+		ctx,
+		otlptracegrpc.WithEndpoint(otlpEndpoint),
+		otlptracegrpc.WithInsecure(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceName(tracingServiceName),
+	))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		// spans of ext_authz checks follow Envoy sampling decision
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(samplingPercent/100))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// Envoy passes trace context of ext_authz call in gRPC metadata,
+// request headers are the fallback when Envoy tracing is not configured
+func extractTraceContext(ctx context.Context, headers map[string]string) context.Context {
+	carrier := propagation.MapCarrier{}
+	for key, value := range headers {
+		carrier[key] = value
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for key, values := range md {
+			if len(values) > 0 {
+				carrier[key] = values[0]
+			}
+		}
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, carrier)
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Traces and measures YT API request
+func doYTRequest(ctx context.Context, method string, request func(ctx context.Context) error) error {
+	ctx, span := tracer.Start(ctx, "yt."+method, trace.WithSpanKind(trace.SpanKindClient))
+	span.SetAttributes(attribute.String("yt.method", method))
+
+	start := time.Now()
+	err := request(ctx)
+	observeYTRequest(method, start, err)
+
+	endSpan(span, err)
+	return err
+}
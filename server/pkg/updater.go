@@ -2,55 +2,386 @@ package pkg
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
 
 	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	resourcev3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"go.ytsaurus.tech/yt/go/yterrors"
 )
 
 type taskUpdater struct {
-	baseDomain  string
-	tls         bool
-	authEnabled bool
+	config SnapshotConfig
 
-	authServer    *authServer
-	taskDiscovery *taskDiscovery
-	cache         cachev3.SnapshotCache
+	authServer *authServer
+	// clusters by name, registered before running
+	clusters  map[string]updaterCluster
+	cache     cachev3.SnapshotCache
+	readiness *readiness
+	logger    *Logger
+
+	// last applied state, tasks of all clusters are served by one snapshot
+	mx           sync.RWMutex
+	clusterTasks map[string]map[string]Task
+	hashToTask   map[string]Task
+	version      string
+	// server certificates and hash of their content, empty if TLS is disabled
+	certificates        []serverCertificate
+	certificatesVersion string
+}
+
+type updaterCluster struct {
+	discovery      *taskDiscovery
+	leaderElection *leaderElection
 }
 
 func CreateTaskUpdater(
-	baseDomain string,
-	tls bool,
-	authEnabled bool,
+	config SnapshotConfig,
 	authServer *authServer,
-	taskDiscovery *taskDiscovery,
 	cache cachev3.SnapshotCache,
+	readiness *readiness,
+	logger *Logger,
 ) *taskUpdater {
 	return &taskUpdater{
-		baseDomain:    baseDomain,
-		tls:           tls,
-		authEnabled:   authEnabled,
-		authServer:    authServer,
-		taskDiscovery: taskDiscovery,
-		cache:         cache,
+		config:       config,
+		authServer:   authServer,
+		clusters:     make(map[string]updaterCluster),
+		cache:        cache,
+		readiness:    readiness,
+		logger:       logger,
+		clusterTasks: make(map[string]map[string]Task),
+		hashToTask:   make(map[string]Task),
 	}
 }
 
-func (u *taskUpdater) Update(ctx context.Context, hashToTask map[string]Task, version string) error {
-	snapshot, err := makeSnapshot(hashToTask, version, u.baseDomain, u.tls, u.authEnabled)
+// Registers cluster of discovery, its leader election decides whether tasks are discovered or read from table
+func (u *taskUpdater) AddCluster(discovery *taskDiscovery, leaderElection *leaderElection) {
+	u.clusters[discovery.cluster] = updaterCluster{discovery: discovery, leaderElection: leaderElection}
+	u.readiness.AddCluster(discovery.cluster)
+}
+
+// Runs leader election and update loop of every cluster
+func (u *taskUpdater) Run(ctx context.Context, period time.Duration) {
+	var wg sync.WaitGroup
+	for name, cluster := range u.clusters {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			cluster.leaderElection.Run(ctx)
+		}()
+		go func() {
+			defer wg.Done()
+			u.runCluster(ctx, name, period)
+		}()
+	}
+	wg.Wait()
+}
+
+// Keeps tasks of cluster up to date: leader discovers tasks and writes services table,
+// followers apply tasks from the table
+func (u *taskUpdater) runCluster(ctx context.Context, cluster string, period time.Duration) {
+	taskDiscovery := u.clusters[cluster].discovery
+	leaderElection := u.clusters[cluster].leaderElection
+	logger := u.logger
+	if cluster != "" {
+		logger = logger.With("cluster", cluster)
+	}
+
+	// state saved in services table is served until the first discovery, which can take minutes on big cluster
+	version, err := u.ApplySaved(ctx, cluster)
+	// server is not ready until discovery, saved tasks can be outdated
 	if err != nil {
-		return fmt.Errorf("failed to make snapshot: %v", err)
+		logger.Warn("failed to apply tasks saved in services table, waiting for discovery", "error", err)
+	} else {
+		logger.Info("applied tasks saved in services table", "version", version)
+	}
+
+	wasLeader := false
+	for {
+		isLeader := leaderElection.IsLeader()
+		if isLeader != wasLeader {
+			// services table could be written by other leader meanwhile, so state is saved from scratch
+			u.ResetSaved(cluster)
+			version = ""
+			wasLeader = isLeader
+		}
+
+		var tasks TaskList
+		var err error
+		// followers serve tasks of the table anyway, but aren't healthy while leader doesn't refresh it
+		leaderAlive := true
+		if isLeader {
+			tasks, err = taskDiscovery.Discovery(ctx)
+		} else {
+			tasks, err = taskDiscovery.LoadTasks(ctx, u.savedTasksMaxAge())
+			if err == nil {
+				leaderAlive = u.leaderAlive(ctx, logger, cluster, period)
+			}
+		}
+		if err != nil {
+			logger.Error("failed to discover tasks", "error", err, "leader", isLeader)
+			u.readiness.DiscoveryFailed(cluster, err)
+			// preserve old version of table, err is probably transient
+			time.Sleep(period)
+			continue
+		}
+		if leaderAlive {
+			u.readiness.DiscoverySucceeded(cluster)
+		} else {
+			u.readiness.DiscoveryFailed(cluster, errLeaderNotAlive)
+		}
+
+		hashToTask, newVersion := MakeHashToTask(tasks)
+		if version == newVersion {
+			logger.Debug("no changes in discovered tasks")
+			if isLeader {
+				if err := u.Refresh(ctx, cluster, hashToTask); err != nil {
+					logger.Error("failed to refresh services table", "error", err)
+				}
+			}
+		} else {
+			logger.Info("tasks discovered", "count", len(tasks), "tasks", tasks, "leader", isLeader)
+			version = newVersion
+
+			if isLeader {
+				err = u.Update(ctx, cluster, hashToTask)
+			} else {
+				err = u.Apply(ctx, cluster, hashToTask)
+			}
+			if err != nil {
+				logger.Error("failed to update tasks", "error", err)
+				version = "" // drop version so we will retry update on next iteration
+			}
+		}
+
+		time.Sleep(period)
+	}
+}
+
+// Applies discovered tasks of cluster and saves them to its services table, done by leader
+func (u *taskUpdater) Update(ctx context.Context, cluster string, hashToTask map[string]Task) error {
+	if err := u.Apply(ctx, cluster, hashToTask); err != nil {
+		return err
+	}
+
+	if err := u.save(ctx, cluster, hashToTask); err != nil {
+		return fmt.Errorf("failed to save tasks to table: %v", err)
+	}
+
+	return nil
+}
+
+var (
+	errLeadershipLost = errors.New("leadership is lost")
+	errLeaderNotAlive = errors.New("leader doesn't save discovery to services table")
+)
+
+// Saves tasks to services table of cluster if the server is still its leader, as leadership can be lost
+// during long discovery, and rows written by new leader would be overwritten; writes are conditional
+// on leader transaction, so lock lost after the check fails them too and they are retried on next round
+func (u *taskUpdater) save(ctx context.Context, cluster string, hashToTask map[string]Task) error {
+	c := u.clusters[cluster]
+	leaderTxID, ok := c.leaderElection.leaderTxID()
+	if !ok {
+		return errLeadershipLost
+	}
+	err := c.discovery.save(ctx, hashToTask, u.tlsEnabled(), leaderTxID)
+	tableWrites.WithLabelValues(outcome(err)).Inc()
+	if err == nil {
+		err = c.discovery.setLastDiscoveryTime(ctx, time.Now(), leaderTxID)
+	}
+	if yterrors.ContainsErrorCode(err, yterrors.CodePrerequisiteCheckFailed) {
+		return fmt.Errorf("%w: %v", errLeadershipLost, err)
+	}
+	return err
+}
+
+// Whether leader of cluster saved discovery recently; tasks of followers go stale if it doesn't
+func (u *taskUpdater) leaderAlive(ctx context.Context, logger *Logger, cluster string, period time.Duration) bool {
+	lastDiscovery, err := u.clusters[cluster].discovery.getLastDiscoveryTime(ctx)
+	if err != nil {
+		logger.Warn("failed to get last discovery time of leader", "error", err)
+		return false
+	}
+	// discovery of leader can take a while on big cluster
+	if age := time.Since(lastDiscovery); age > 2*period+leaderTxTimeout {
+		logger.Warn("leader didn't save discovery recently", "last_discovery", lastDiscovery)
+		return false
+	}
+	return true
+}
+
+// Applies tasks of cluster together with tasks of other clusters to xDS snapshot and auth without saving,
+// done by followers
+func (u *taskUpdater) Apply(ctx context.Context, cluster string, hashToTask map[string]Task) error {
+	// applies of different clusters are serialized, so snapshot has the latest tasks of each cluster
+	u.mx.Lock()
+	defer u.mx.Unlock()
+
+	var tasks TaskList
+	for name, clusterHashToTask := range u.clusterTasks {
+		if name != cluster {
+			tasks = slices.AppendSeq(tasks, maps.Values(clusterHashToTask))
+		}
+	}
+	tasks = slices.AppendSeq(tasks, maps.Values(hashToTask))
+	// task IDs include cluster name, so hashes of different clusters don't collide
+	mergedHashToTask, version := MakeHashToTask(tasks)
+
+	u.authServer.SetHashToTasks(mergedHashToTask)
+
+	if err := u.setSnapshot(ctx, mergedHashToTask, version, u.certificates, u.certificatesVersion); err != nil {
+		return err
 	}
 
-	u.authServer.SetHashToTasks(hashToTask)
+	u.clusterTasks[cluster] = hashToTask
+	u.hashToTask = mergedHashToTask
+	u.version = version
 
+	return nil
+}
+
+// Replaces server certificates, listener gets TLS when certificates appear; it's never downgraded to plaintext
+// if TLS is required
+func (u *taskUpdater) SetCertificates(ctx context.Context, certificates []serverCertificate, version string) error {
+	if u.config.TLSRequired && len(certificates) == 0 {
+		return fmt.Errorf("no TLS certificates, while TLS is required")
+	}
+
+	u.mx.Lock()
+	defer u.mx.Unlock()
+
+	// snapshot without tasks is not pushed, certificates are served with the first tasks
+	if len(u.clusterTasks) > 0 {
+		if err := u.setSnapshot(ctx, u.hashToTask, u.version, certificates, version); err != nil {
+			return err
+		}
+	}
+	u.certificates = certificates
+	u.certificatesVersion = version
+	return nil
+}
+
+func (u *taskUpdater) setSnapshot(
+	ctx context.Context,
+	hashToTask map[string]Task,
+	version string,
+	certificates []serverCertificate,
+	certificatesVersion string,
+) error {
+	config := u.config
+	config.Certificates = certificates
+	if certificatesVersion != "" {
+		version = Hash([]byte(version + certificatesVersion))
+	}
+
+	snapshot, err := makeSnapshot(hashToTask, version, config)
+	if err != nil {
+		return fmt.Errorf("failed to make snapshot: %v", err)
+	}
 	if err := u.cache.SetSnapshot(ctx, NodeID, snapshot); err != nil {
 		return fmt.Errorf("failed to set snapshot: %v", err)
 	}
+	snapshotVersionChanges.Inc()
+	if u.config.TLSRequired && len(certificates) == 0 {
+		// snapshot has ACME challenges listener only, server is not ready until certificates are loaded
+		u.logger.Warn("no TLS certificates loaded yet, tasks are not served")
+		return nil
+	}
+	u.readiness.SetSnapshotSet()
+	return nil
+}
+
+// Task URLs in services table are https when certificates are served
+func (u *taskUpdater) tlsEnabled() bool {
+	u.mx.RLock()
+	defer u.mx.RUnlock()
 
-	err = u.taskDiscovery.save(ctx, hashToTask)
+	return u.config.TLSRequired || len(u.certificates) > 0
+}
+
+// Applies tasks saved in services table of cluster by previous leader, to serve them until discovery finishes;
+// returns version of applied cluster tasks
+func (u *taskUpdater) ApplySaved(ctx context.Context, cluster string) (string, error) {
+	tasks, err := u.clusters[cluster].discovery.LoadTasks(ctx, u.savedTasksMaxAge())
 	if err != nil {
-		return fmt.Errorf("failed to save tasks to table: %v", err)
+		return "", fmt.Errorf("failed to load tasks from table: %v", err)
 	}
+	hashToTask, version := MakeHashToTask(tasks)
+	if err := u.Apply(ctx, cluster, hashToTask); err != nil {
+		return "", err
+	}
+	u.readiness.SavedApplied(cluster)
+	return version, nil
+}
 
-	return nil
+// Live leader refreshes last_seen of unchanged rows once in lastSeenRefreshPeriod, so older rows
+// are not refreshed for longer than readiness tolerates discovery failures
+func (u *taskUpdater) savedTasksMaxAge() time.Duration {
+	return lastSeenRefreshPeriod + u.readiness.stalenessThreshold
+}
+
+// Forgets services table state of cluster, as other leader could write to it
+func (u *taskUpdater) ResetSaved(cluster string) {
+	u.clusters[cluster].discovery.savedRows = nil
+}
+
+// Saves discovered tasks of cluster whose routing is unchanged, so services table rows get fresh last_seen
+// and attributes not affecting routing, e.g. pool or user
+func (u *taskUpdater) Refresh(ctx context.Context, cluster string, hashToTask map[string]Task) error {
+	u.mx.RLock()
+	_, ok := u.clusterTasks[cluster]
+	u.mx.RUnlock()
+	if !ok {
+		// nothing is applied yet, empty state would remove rows of previous server instance
+		return nil
+	}
+	return u.save(ctx, cluster, hashToTask)
+}
+
+func (u *taskUpdater) getTasks() (map[string]Task, string) {
+	u.mx.RLock()
+	defer u.mx.RUnlock()
+
+	return u.hashToTask, u.version
+}
+
+// Errors of last discovery cycle of all clusters, and clusters whose discovery is failing
+func (u *taskUpdater) getOperationErrors() []OperationError {
+	errs := make([]OperationError, 0)
+	errs = append(errs, u.readiness.discoveryErrors()...)
+	for _, cluster := range slices.Sorted(maps.Keys(u.clusters)) {
+		errs = append(errs, u.clusters[cluster].discovery.getOperationErrors()...)
+	}
+	return errs
+}
+
+type SnapshotInfo struct {
+	Version   string         `json:"version"`
+	Resources map[string]int `json:"resources"`
+}
+
+// Version and resource counts of snapshot currently served to Envoy
+func (u *taskUpdater) getSnapshotInfo() (*SnapshotInfo, error) {
+	snapshot, err := u.cache.GetSnapshot(NodeID)
+	if err != nil {
+		return nil, err
+	}
+	info := &SnapshotInfo{
+		Version:   snapshot.GetVersion(resourcev3.ListenerType),
+		Resources: make(map[string]int),
+	}
+	for name, typeURL := range map[string]string{
+		"clusters":  resourcev3.ClusterType,
+		"listeners": resourcev3.ListenerType,
+		"routes":    resourcev3.RouteType,
+		"secrets":   resourcev3.SecretType,
+	} {
+		info.Resources[name] = len(snapshot.GetResources(typeURL))
+	}
+	return info, nil
 }
@@ -0,0 +1,342 @@
+package pkg
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.ytsaurus.tech/yt/go/schema"
+	"go.ytsaurus.tech/yt/go/ypath"
+	"go.ytsaurus.tech/yt/go/yson"
+	ytsdk "go.ytsaurus.tech/yt/go/yt"
+	"go.ytsaurus.tech/yt/go/yterrors"
+)
+
+// Services table stand-in, rows are read through YSON as from YT
+type servicesTableYT struct {
+	ytsdk.Client
+
+	rows []TaskRow
+}
+
+func (y *servicesTableYT) SelectRows(context.Context, string, *ytsdk.SelectRowsOptions) (ytsdk.TableReader, error) {
+	return &rowsReader{rows: y.rows, index: -1}, nil
+}
+
+type rowsReader struct {
+	rows  []TaskRow
+	index int
+}
+
+func (r *rowsReader) Scan(value any) error {
+	data, err := yson.Marshal(r.rows[r.index])
+	if err != nil {
+		return err
+	}
+	return yson.Unmarshal(data, value)
+}
+
+func (r *rowsReader) Next() bool {
+	r.index++
+	return r.index < len(r.rows)
+}
+
+func (r *rowsReader) Err() error   { return nil }
+func (r *rowsReader) Close() error { return nil }
+
+func TestApplySaved(t *testing.T) {
+	discovered := TaskList{
+		{
+			operationID: "op1",
+			taskName:    "server",
+			service:     "api",
+			protocol:    GRPC,
+			jobs:        []HostPort{{host: "node1", port: 9000}},
+			options:     parseServiceOptions(map[string]any{"grpc_web": true}, GRPC),
+			rawOptions:  map[string]any{"grpc_web": true},
+			jobIDs:      []string{"1-2-3-4"},
+		},
+		{
+			operationID: "op2",
+			taskName:    "driver",
+			service:     "ui",
+			protocol:    HTTP,
+			jobs:        []HostPort{{host: "node2", port: 4040}},
+			provider:    spytDirectSubmitProvider,
+		},
+	}
+	hashToTask, version := MakeHashToTask(discovered)
+
+	now, err := schema.NewTimestamp(time.Now())
+	require.NoError(t, err)
+	var rows []TaskRow
+	for hash, task := range hashToTask {
+		row := makeTaskRow(hash, task, testSnapshotConfig.BaseDomain, false)
+		row.LastSeen = now
+		rows = append(rows, row)
+	}
+	// leader stopped refreshing this row long ago, its job can be gone
+	staleRow := makeTaskRow("00000003", Task{operationID: "op3", taskName: "driver", service: "ui", protocol: HTTP},
+		testSnapshotConfig.BaseDomain, false)
+	staleRow.LastSeen, err = schema.NewTimestamp(time.Now().Add(-24 * time.Hour))
+	require.NoError(t, err)
+	rows = append(rows, staleRow)
+
+	logger := createTestLogger()
+	readiness := CreateReadiness(time.Minute)
+	discovery := CreateTaskDiscovery("", testSnapshotConfig.BaseDomain, "//tmp", 0, &servicesTableYT{rows: rows}, logger)
+	authServer := CreateAuthServer(logger, "")
+	cache := cachev3.NewSnapshotCache(false, cachev3.IDHash{}, logger.CacheLogger())
+	taskUpdater := CreateTaskUpdater(testSnapshotConfig, authServer, cache, readiness, logger)
+	taskUpdater.AddCluster(discovery, nil)
+
+	savedVersion, err := taskUpdater.ApplySaved(context.Background(), "")
+	require.NoError(t, err)
+	// the same version as discovered tasks have, so unchanged discovery doesn't push snapshot again
+	assert.Equal(t, version, savedVersion)
+	assert.Len(t, authServer.getHashToTasks(), 2)
+	// saved tasks of every cluster are served until discovery, which isn't reported as succeeded
+	readiness.SetGRPCServing()
+	assert.NoError(t, readiness.ready())
+	assert.False(t, readiness.discoveries[""].succeeded)
+
+	info, err := taskUpdater.getSnapshotInfo()
+	require.NoError(t, err)
+	assert.Equal(t, version, info.Version)
+	assert.Equal(t, 3, info.Resources["clusters"]) // tasks and ext_authz
+}
+
+func TestApplyClusters(t *testing.T) {
+	logger := createTestLogger()
+	authServer := CreateAuthServer(logger, "")
+	cache := cachev3.NewSnapshotCache(false, cachev3.IDHash{}, logger.CacheLogger())
+	taskUpdater := CreateTaskUpdater(testSnapshotConfig, authServer, cache, CreateReadiness(time.Minute), logger)
+	for _, cluster := range []string{"hahn", "arnold"} {
+		taskUpdater.AddCluster(CreateTaskDiscovery(cluster, testSnapshotConfig.BaseDomain, "//tmp", 0, nil, logger), nil)
+	}
+
+	makeClusterTasks := func(cluster string) map[string]Task {
+		hashToTask, _ := MakeHashToTask(TaskList{{
+			cluster:     cluster,
+			operationID: "op1",
+			taskName:    "driver",
+			service:     "ui",
+			protocol:    HTTP,
+			jobs:        []HostPort{{host: "node1", port: 4040}},
+		}})
+		return hashToTask
+	}
+
+	ctx := context.Background()
+	require.NoError(t, taskUpdater.Apply(ctx, "hahn", makeClusterTasks("hahn")))
+	require.NoError(t, taskUpdater.Apply(ctx, "arnold", makeClusterTasks("arnold")))
+
+	// the same operation on both clusters makes two tasks
+	hashToTask, _ := taskUpdater.getTasks()
+	assert.Len(t, hashToTask, 2)
+	assert.Len(t, authServer.getHashToTasks(), 2)
+
+	// update of one cluster keeps tasks of other one
+	require.NoError(t, taskUpdater.Apply(ctx, "hahn", map[string]Task{}))
+	hashToTask, _ = taskUpdater.getTasks()
+	assert.Equal(t, makeClusterTasks("arnold"), hashToTask)
+
+	info, err := taskUpdater.getSnapshotInfo()
+	require.NoError(t, err)
+	assert.Equal(t, 2, info.Resources["clusters"]) // task of arnold and ext_authz
+}
+
+// Services table whose leader saved discovery at lastDiscovery, never if it's empty
+type lastDiscoveryYT struct {
+	ytsdk.Client
+
+	lastDiscovery string
+}
+
+func (y *lastDiscoveryYT) GetNode(_ context.Context, _ ypath.YPath, result any, _ *ytsdk.GetNodeOptions) error {
+	if y.lastDiscovery == "" {
+		return yterrors.Err(yterrors.CodeResolveError, "attribute not found")
+	}
+	data, err := yson.Marshal(y.lastDiscovery)
+	if err != nil {
+		return err
+	}
+	return yson.Unmarshal(data, result)
+}
+
+func TestLeadership(t *testing.T) {
+	logger := createTestLogger()
+	yt := &lastDiscoveryYT{}
+	authServer := CreateAuthServer(logger, "")
+	cache := cachev3.NewSnapshotCache(false, cachev3.IDHash{}, logger.CacheLogger())
+	taskUpdater := CreateTaskUpdater(testSnapshotConfig, authServer, cache, CreateReadiness(time.Minute), logger)
+	taskUpdater.AddCluster(
+		CreateTaskDiscovery("", testSnapshotConfig.BaseDomain, "//tmp", 0, yt, logger),
+		CreateLeaderElection("", "//tmp", yt, logger),
+	)
+
+	// tasks of former leader are applied, but not written over rows of new one
+	hashToTask, _ := MakeHashToTask(TaskList{{operationID: "op1", taskName: "driver", service: "ui", protocol: HTTP}})
+	err := taskUpdater.Update(context.Background(), "", hashToTask)
+	require.ErrorContains(t, err, errLeadershipLost.Error())
+	tasks, _ := taskUpdater.getTasks()
+	assert.Len(t, tasks, 1)
+
+	period := time.Minute
+	assert.False(t, taskUpdater.leaderAlive(context.Background(), logger, "", period))
+	yt.lastDiscovery = time.Now().Add(-time.Hour).Format(time.RFC3339)
+	assert.False(t, taskUpdater.leaderAlive(context.Background(), logger, "", period))
+	yt.lastDiscovery = time.Now().Add(-period).Format(time.RFC3339)
+	assert.True(t, taskUpdater.leaderAlive(context.Background(), logger, "", period))
+}
+
+// Leader lock transaction, finished when the lock is lost
+type leaderTx struct {
+	ytsdk.Tx
+
+	id       ytsdk.TxID
+	finished chan struct{}
+}
+
+func (tx *leaderTx) ID() ytsdk.TxID            { return tx.id }
+func (tx *leaderTx) Finished() <-chan struct{} { return tx.finished }
+
+func (tx *leaderTx) alive() bool {
+	select {
+	case <-tx.finished:
+		return false
+	default:
+		return true
+	}
+}
+
+// Services table whose writes fail prerequisite check once leader lock is lost, as YT does
+type prerequisiteYT struct {
+	ytsdk.Client
+
+	leader *leaderTx
+	// lock is lost while rows are written
+	loseOnInsert bool
+	committed    []any
+	prerequisite []ytsdk.TxID
+}
+
+func (y *prerequisiteYT) checkPrerequisite(options *ytsdk.PrerequisiteOptions) error {
+	y.prerequisite = options.TransactionIDs
+	if !slices.Equal(options.TransactionIDs, []ytsdk.TxID{y.leader.id}) || !y.leader.alive() {
+		return yterrors.Err(yterrors.CodePrerequisiteCheckFailed, "prerequisite check failed")
+	}
+	return nil
+}
+
+func (y *prerequisiteYT) BeginTabletTx(context.Context, *ytsdk.StartTabletTxOptions) (ytsdk.TabletTx, error) {
+	return &prerequisiteTabletTx{yt: y}, nil
+}
+
+func (y *prerequisiteYT) SetNode(_ context.Context, _ ypath.YPath, _ any, options *ytsdk.SetNodeOptions) error {
+	return y.checkPrerequisite(options.PrerequisiteOptions)
+}
+
+type prerequisiteTabletTx struct {
+	ytsdk.TabletTx
+	ytsdk.LowLevelTxClient
+
+	yt *prerequisiteYT
+	// inserted rows and deleted keys
+	rows []any
+}
+
+func (tx *prerequisiteTabletTx) InsertRows(_ context.Context, _ ypath.Path, rows []any, _ *ytsdk.InsertRowsOptions) error {
+	tx.rows = append(tx.rows, rows...)
+	if tx.yt.loseOnInsert {
+		close(tx.yt.leader.finished)
+	}
+	return nil
+}
+
+func (tx *prerequisiteTabletTx) DeleteRows(_ context.Context, _ ypath.Path, keys []any, _ *ytsdk.DeleteRowsOptions) error {
+	tx.rows = append(tx.rows, keys...)
+	return nil
+}
+
+func (tx *prerequisiteTabletTx) ID() ytsdk.TxID { return ytsdk.TxID{} }
+func (tx *prerequisiteTabletTx) Abort() error   { return nil }
+
+func (tx *prerequisiteTabletTx) CommitTx(_ context.Context, _ ytsdk.TxID, options *ytsdk.CommitTxOptions) error {
+	if err := tx.yt.checkPrerequisite(options.PrerequisiteOptions); err != nil {
+		return err
+	}
+	tx.yt.committed = append(tx.yt.committed, tx.rows...)
+	return nil
+}
+
+func TestLeadershipLostDuringSave(t *testing.T) {
+	logger := createTestLogger()
+	yt := &prerequisiteYT{leader: &leaderTx{id: ytsdk.TxID{1, 2, 3, 4}, finished: make(chan struct{})}}
+	authServer := CreateAuthServer(logger, "")
+	cache := cachev3.NewSnapshotCache(false, cachev3.IDHash{}, logger.CacheLogger())
+	taskUpdater := CreateTaskUpdater(testSnapshotConfig, authServer, cache, CreateReadiness(time.Minute), logger)
+	discovery := CreateTaskDiscovery("", testSnapshotConfig.BaseDomain, "//tmp", 0, yt, logger)
+	leaderElection := CreateLeaderElection("", "//tmp", yt, logger)
+	taskUpdater.AddCluster(discovery, leaderElection)
+	leaderElection.setLeader(yt.leader)
+	ctx := context.Background()
+
+	// rows and last discovery time are written only while leader lock is held
+	discovery.savedRows = map[string]TaskRow{}
+	hashToTask, _ := MakeHashToTask(TaskList{{operationID: "op1", taskName: "driver", service: "ui", protocol: HTTP}})
+	require.NoError(t, taskUpdater.Update(ctx, "", hashToTask))
+	assert.Len(t, yt.committed, 1)
+	assert.Equal(t, []ytsdk.TxID{yt.leader.id}, yt.prerequisite)
+
+	// lock is lost after leadership check, commit fails instead of overwriting rows of new leader
+	yt.loseOnInsert = true
+	hashToTask, _ = MakeHashToTask(TaskList{{operationID: "op2", taskName: "driver", service: "ui", protocol: HTTP}})
+	err := taskUpdater.Update(ctx, "", hashToTask)
+	require.ErrorContains(t, err, errLeadershipLost.Error())
+	assert.Len(t, yt.committed, 1)
+	// table state is loaded again by the next leader round
+	assert.Nil(t, discovery.savedRows)
+	assert.False(t, leaderElection.IsLeader())
+}
+
+func TestTLSRequired(t *testing.T) {
+	logger := createTestLogger()
+	config := testSnapshotConfig
+	config.TLSRequired = true
+	authServer := CreateAuthServer(logger, "")
+	cache := cachev3.NewSnapshotCache(false, cachev3.IDHash{}, logger.CacheLogger())
+	readiness := CreateReadiness(time.Minute)
+	taskUpdater := CreateTaskUpdater(config, authServer, cache, readiness, logger)
+	taskUpdater.AddCluster(CreateTaskDiscovery("", config.BaseDomain, "//tmp", 0, nil, logger), nil)
+	ctx := context.Background()
+
+	// plaintext listener is not served until certificate is issued
+	hashToTask, _ := MakeHashToTask(TaskList{{operationID: "op1", taskName: "driver", service: "ui", protocol: HTTP}})
+	require.NoError(t, taskUpdater.Apply(ctx, "", hashToTask))
+	info, err := taskUpdater.getSnapshotInfo()
+	require.NoError(t, err)
+	assert.Equal(t, 0, info.Resources["listeners"])
+	assert.Equal(t, 0, info.Resources["clusters"])
+	assert.False(t, readiness.snapshotSet)
+	assert.True(t, taskUpdater.tlsEnabled())
+
+	certificates := []serverCertificate{{secret: &tlsv3.Secret{Name: "server_cert_0"}}}
+	require.NoError(t, taskUpdater.SetCertificates(ctx, certificates, "1"))
+	info, err = taskUpdater.getSnapshotInfo()
+	require.NoError(t, err)
+	assert.Equal(t, 1, info.Resources["secrets"])
+	assert.Equal(t, 1, info.Resources["listeners"])
+	assert.True(t, readiness.snapshotSet)
+
+	// removed certificate doesn't downgrade listener
+	require.Error(t, taskUpdater.SetCertificates(ctx, nil, ""))
+	info, err = taskUpdater.getSnapshotInfo()
+	require.NoError(t, err)
+	assert.Equal(t, 1, info.Resources["secrets"])
+}
@@ -1,34 +1,69 @@
 package pkg
 
 import (
-	"log"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
 	"time"
 
 	ytsdk "go.ytsaurus.tech/yt/go/yt"
 	ythttpsdk "go.ytsaurus.tech/yt/go/yt/ythttp"
 )
 
-type SimpleLogger struct{}
-
-func (SimpleLogger) Debugf(format string, args ...any) {
-	log.Printf("DEBUG: "+format, args...)
-}
-func (SimpleLogger) Infof(format string, args ...any) {
-	log.Printf("INFO:  "+format, args...)
-}
-func (SimpleLogger) Warnf(format string, args ...any) {
-	log.Printf("WARN:  "+format, args...)
-}
-func (SimpleLogger) Errorf(format string, args ...any) {
-	log.Printf("ERROR: "+format, args...)
+// Connection to YT HTTP proxies
+type YTConnection struct {
+	// address in form [scheme://]host[:port], https scheme enables TLS
+	Proxy  string `yaml:"proxy"`
+	UseTLS bool   `yaml:"use_tls"`
+	// PEM bundle with CA certificates trusted in addition to system ones
+	CAPath string `yaml:"ca_path"`
+	// requests are spread over proxies listed by the address; disabled for balancer address when proxies
+	// behind it are not reachable
+	ProxyDiscovery bool   `yaml:"proxy_discovery"`
+	ProxyRole      string `yaml:"proxy_role"`
 }
 
-func CreateYTClient(proxy string, credentials ytsdk.Credentials) (ytsdk.Client, error) {
+// Client config without credentials
+func (c YTConnection) ytConfig() (ytsdk.Config, error) {
 	timeout := time.Second * 10
-	return ythttpsdk.NewClient(&ytsdk.Config{
-		Proxy:                 proxy,
-		Credentials:           credentials,
+	config := ytsdk.Config{
+		Proxy:                 c.Proxy,
+		UseTLS:                c.UseTLS,
+		ProxyRole:             c.ProxyRole,
 		LightRequestTimeout:   &timeout,
-		DisableProxyDiscovery: true,
-	})
+		DisableProxyDiscovery: !c.ProxyDiscovery,
+	}
+	if c.CAPath != "" {
+		caData, err := os.ReadFile(c.CAPath)
+		if err != nil {
+			return ytsdk.Config{}, fmt.Errorf("failed to read YT CA bundle: %w", err)
+		}
+		config.CertificateAuthorityData = caData
+	}
+	return config, nil
+}
+
+func CreateYTClient(connection YTConnection, credentials ytsdk.Credentials) (ytsdk.Client, error) {
+	config, err := connection.ytConfig()
+	if err != nil {
+		return nil, err
+	}
+	config.Credentials = credentials
+	return ythttpsdk.NewClient(&config)
+}
+
+// Checks host:port of endpoint which is made Envoy cluster, e.g. OTLP collector or ACME solver
+func ValidateEndpoint(endpoint string) error {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("empty host in %q", endpoint)
+	}
+	if portI, err := strconv.ParseUint(port, 10, 16); err != nil || portI == 0 {
+		return fmt.Errorf("invalid port in %q", endpoint)
+	}
+	return nil
 }
@@ -0,0 +1,41 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestYTConnectionConfig(t *testing.T) {
+	config, err := YTConnection{Proxy: "http-proxies-lb.yt.svc.cluster.local"}.ytConfig()
+	require.NoError(t, err)
+	assert.True(t, config.DisableProxyDiscovery)
+	assert.Nil(t, config.CertificateAuthorityData)
+
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caPath, []byte("-----BEGIN CERTIFICATE-----\n"), 0o644))
+	config, err = YTConnection{Proxy: "yt.example.net", UseTLS: true, CAPath: caPath, ProxyDiscovery: true}.ytConfig()
+	require.NoError(t, err)
+	assert.False(t, config.DisableProxyDiscovery)
+	assert.True(t, config.UseTLS)
+	assert.Equal(t, []byte("-----BEGIN CERTIFICATE-----\n"), config.CertificateAuthorityData)
+
+	_, err = YTConnection{Proxy: "yt.example.net", CAPath: filepath.Join(t.TempDir(), "missing.pem")}.ytConfig()
+	assert.Error(t, err)
+}
+
+func TestValidateEndpoint(t *testing.T) {
+	for endpoint, valid := range map[string]bool{
+		"otel-collector.monitoring:4317": true,
+		"127.0.0.1:4317":                 true,
+		"otel-collector":                 false,
+		":4317":                          false,
+		"otel-collector:otlp":            false,
+		"otel-collector:70000":           false,
+	} {
+		assert.Equal(t, valid, ValidateEndpoint(endpoint) == nil, endpoint)
+	}
+}
@@ -2,8 +2,9 @@ package pkg
 
 import (
 	"fmt"
-	"log"
+	"maps"
 	"net"
+	"slices"
 	"time"
 
 	"google.golang.org/grpc"
@@ -18,9 +19,13 @@ import (
 	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
 	listenerv3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
 	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	tracev3 "github.com/envoyproxy/go-control-plane/envoy/config/trace/v3"
 	accesslogstream3 "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/stream/v3"
+	corsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/cors/v3"
 	extauthzv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_authz/v3"
+	grpcwebv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/grpc_web/v3"
 	routerv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/router/v3"
+	tlsinspectorv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/listener/tls_inspector/v3"
 	hcmv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
 	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
 	httpv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/upstreams/http/v3"
@@ -28,7 +33,9 @@ import (
 	clustergrpc "github.com/envoyproxy/go-control-plane/envoy/service/cluster/v3"
 	discoverygrpc "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
 	listenergrpc "github.com/envoyproxy/go-control-plane/envoy/service/listener/v3"
+	secretgrpc "github.com/envoyproxy/go-control-plane/envoy/service/secret/v3"
 	matcherv3 "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
 	cachetypes "github.com/envoyproxy/go-control-plane/pkg/cache/types"
 	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
 	resourcev3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
@@ -36,12 +43,53 @@ import (
 )
 
 const (
-	extAuthClusterName = "extAuthz"
-	routerHeaderName   = "x-yt-taskproxy-id"
+	extAuthClusterName       = "extAuthz"
+	otlpClusterName          = "otlpCollector"
+	acmeChallengeClusterName = "acmeChallenge"
+	acmeChallengePathPrefix  = "/.well-known/acme-challenge/"
+	routerHeaderName         = "x-yt-taskproxy-id"
+	websocketUpgrade         = "websocket"
+
+	corsFilterName    = "envoy.filters.http.cors"
+	grpcWebFilterName = "envoy.filters.http.grpc_web"
 )
 
-func ServeGRPC(s serverv3.Server, authServer *authServer) error {
-	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", serverPort))
+type SnapshotConfig struct {
+	BaseDomain string
+	// task domains are served under these base domains too, e.g. legacy ones during migration
+	AdditionalBaseDomains []string
+	// server certificates served to Envoy over SDS, listener is plaintext if empty
+	Certificates []serverCertificate
+	// certificates are configured, so snapshot without them isn't served and credentials never go in plaintext
+	TLSRequired bool
+	// plaintext listener redirecting to HTTPS when certificates are served, and serving ACME challenges
+	HTTPRedirect bool
+	// host:port of ACME HTTP-01 solver serving challenges on redirect listener, e.g. cert-manager one
+	ACMEChallengeEndpoint string
+	// Strict-Transport-Security max-age of HTTPS responses, zero disables header
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+	// client certificates requested on TLS listener, verified with PEM bundle of client CA
+	ClientCertificateMode ClientCertificateMode
+	ClientCA              []byte
+	AuthEnabled           bool
+	// Exact origins allowed for gRPC-Web CORS requests, any origin without credentials if empty
+	GRPCWebAllowedOrigins []string
+	// Route defaults for services without own settings in annotation
+	RouteTimeout     time.Duration
+	RouteIdleTimeout time.Duration // zero keeps Envoy default stream idle timeout
+	RetryOn          string        // empty disables retries
+	NumRetries       uint32
+	// TTL of generated session affinity cookie, zero makes session cookie
+	StickyCookieTTL time.Duration
+	// OTLP gRPC collector host:port for Envoy tracing, tracing is disabled if empty
+	OTLPEndpoint         string
+	TraceSamplingPercent float64
+}
+
+func ServeGRPC(s serverv3.Server, authServer *authServer, readiness *readiness, logger *Logger) error {
+	// only Envoy of the pod is a client: snapshot has server private keys and isn't authenticated
+	lis, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", serverPort))
 	if err != nil {
 		return err
 	}
@@ -50,49 +98,91 @@ func ServeGRPC(s serverv3.Server, authServer *authServer) error {
 	discoverygrpc.RegisterAggregatedDiscoveryServiceServer(gs, s)
 	clustergrpc.RegisterClusterDiscoveryServiceServer(gs, s)
 	listenergrpc.RegisterListenerDiscoveryServiceServer(gs, s)
+	secretgrpc.RegisterSecretDiscoveryServiceServer(gs, s)
 
 	authv3.RegisterAuthorizationServer(gs, authServer)
 
-	log.Printf("xDS + extAuthz starts listening on :%d", serverPort)
+	logger.Info("xDS + extAuthz starts listening", "port", serverPort)
+	readiness.SetGRPCServing()
 
 	return gs.Serve(lis)
 }
 
-func makeSnapshot(hashToTask map[string]Task, version string, baseDomain string, tls bool, authEnabled bool) (*cachev3.Snapshot, error) {
+func makeSnapshot(hashToTask map[string]Task, version string, config SnapshotConfig) (*cachev3.Snapshot, error) {
 	var clusters []cachetypes.Resource
 	var vhosts []*routev3.VirtualHost
 
 	var defaultVhostRoutes []*routev3.Route
 
-	for hash, task := range hashToTask {
+	grpcWebEnabled := false
+	for _, task := range hashToTask {
+		if task.protocol == GRPC && task.options.grpcWeb {
+			grpcWebEnabled = true
+			break
+		}
+	}
+
+	// sorted, so equal tasks make equal resources
+	for _, hash := range slices.Sorted(maps.Keys(hashToTask)) {
+		task := hashToTask[hash]
 		grpc := task.protocol == "grpc"
 		vhostName := fmt.Sprintf("%s-%s-%s", task.operationID, task.taskName, task.service)
-
-		var vhostClusters []*routev3.WeightedCluster_ClusterWeight
-		for i, job := range task.jobs {
-			clusterName := fmt.Sprintf("%s-%d", vhostName, i)
-			clusters = append(clusters, makeCluster(clusterName, job.host, job.port, grpc, true))
-			vhostClusters = append(vhostClusters, &routev3.WeightedCluster_ClusterWeight{
-				Name:   clusterName,
-				Weight: &wrapperspb.UInt32Value{Value: 1},
-			})
+		if task.cluster != "" {
+			vhostName = task.cluster + "-" + vhostName
 		}
-		action := &routev3.Route_Route{
-			Route: &routev3.RouteAction{
-				ClusterSpecifier: &routev3.RouteAction_WeightedClusters{
-					WeightedClusters: &routev3.WeightedCluster{
-						Clusters: vhostClusters,
-					},
-				},
+
+		// one cluster for all task jobs, so health checks and outlier detection move traffic between jobs
+		cluster := makeCluster(vhostName, task.jobs, grpc, true, task.options)
+		cluster.OutlierDetection = &clusterv3.OutlierDetection{}
+		clusters = append(clusters, cluster)
+
+		routeAction := &routev3.RouteAction{
+			ClusterSpecifier: &routev3.RouteAction_Cluster{
+				Cluster: vhostName,
 			},
+			Timeout: durationpb.New(task.options.timeout.getOr(config.RouteTimeout)),
+		}
+		if task.options.idleTimeout.set {
+			routeAction.IdleTimeout = durationpb.New(task.options.idleTimeout.value)
+		} else if config.RouteIdleTimeout > 0 {
+			routeAction.IdleTimeout = durationpb.New(config.RouteIdleTimeout)
+		}
+		if retryOn := task.options.retryOn.getOr(config.RetryOn); retryOn != "" {
+			routeAction.RetryPolicy = &routev3.RetryPolicy{
+				RetryOn:    retryOn,
+				NumRetries: &wrapperspb.UInt32Value{Value: task.options.numRetries.getOr(config.NumRetries)},
+			}
+		}
+		if sticky := task.options.sticky; sticky.enabled {
+			routeAction.HashPolicy = []*routev3.RouteAction_HashPolicy{makeStickyHashPolicy(sticky, config.StickyCookieTTL)}
+		}
+		if task.options.websocket {
+			// upgrade requests pass through the same HTTP filters, so ext_authz checks them as well
+			routeAction.UpgradeConfigs = []*routev3.RouteAction_UpgradeConfig{{
+				UpgradeType: websocketUpgrade,
+				Enabled:     &wrapperspb.BoolValue{Value: true},
+			}}
+		}
+		action := &routev3.Route_Route{Route: routeAction}
+
+		var typedPerFilterConfig map[string]*anypb.Any
+		if grpc && task.options.grpcWeb {
+			typedPerFilterConfig = map[string]*anypb.Any{
+				corsFilterName: mustAny(makeGRPCWebCorsPolicy(config.GRPCWebAllowedOrigins)),
+			}
+		} else if grpcWebEnabled {
+			typedPerFilterConfig = map[string]*anypb.Any{
+				grpcWebFilterName: mustAny(&routev3.FilterConfig{Disabled: true}),
+			}
 		}
 		// route either by domain
 		vhosts = append(vhosts, &routev3.VirtualHost{
 			Name:    vhostName,
-			Domains: []string{getTaskDomain(hash, baseDomain)},
+			Domains: taskDomains(hash, task, config),
 			Routes: []*routev3.Route{{
-				Match:  &routev3.RouteMatch{PathSpecifier: &routev3.RouteMatch_Prefix{Prefix: "/"}},
-				Action: action,
+				Match:                &routev3.RouteMatch{PathSpecifier: &routev3.RouteMatch_Prefix{Prefix: "/"}},
+				Action:               action,
+				TypedPerFilterConfig: typedPerFilterConfig,
 			}},
 		})
 		// ... or by custom header
@@ -112,7 +202,8 @@ func makeSnapshot(hashToTask map[string]Task, version string, baseDomain string,
 					},
 				},
 			},
-			Action: action,
+			Action:               action,
+			TypedPerFilterConfig: typedPerFilterConfig,
 		})
 	}
 
@@ -133,12 +224,18 @@ func makeSnapshot(hashToTask map[string]Task, version string, baseDomain string,
 		Routes:  defaultVhostRoutes,
 	})
 
-	if authEnabled {
-		authzCluster := makeCluster(extAuthClusterName, "127.0.0.1", serverPort, true, false)
+	if config.AuthEnabled {
+		authzCluster := makeCluster(
+			extAuthClusterName,
+			[]HostPort{{host: "127.0.0.1", port: serverPort}},
+			true,
+			false,
+			serviceOptions{},
+		)
 		clusters = append(clusters, authzCluster)
 	}
 
-	// HTTP filters: ext_authz before router
+	// HTTP filters: (cors, grpc_web), ext_authz before router
 	authz := &extauthzv3.ExtAuthz{
 		Services: &extauthzv3.ExtAuthz_GrpcService{
 			GrpcService: &corev3.GrpcService{
@@ -150,12 +247,27 @@ func makeSnapshot(hashToTask map[string]Task, version string, baseDomain string,
 				Timeout: durationpb.New(800 * time.Millisecond),
 			},
 		},
-		FailureModeAllow:       false,
-		IncludePeerCertificate: false,
+		FailureModeAllow: false,
+		// verified client certificate identifies user instead of YT credentials
+		IncludePeerCertificate: config.ClientCertificateMode != ClientCertificateNone,
 	}
 
 	var httpFilters []*hcmv3.HttpFilter
-	if authEnabled {
+	if grpcWebEnabled {
+		// CORS goes first to answer preflight requests, which have no credentials for ext_authz
+		httpFilters = append(httpFilters, &hcmv3.HttpFilter{
+			Name: corsFilterName,
+			ConfigType: &hcmv3.HttpFilter_TypedConfig{
+				TypedConfig: mustAny(&corsv3.Cors{}),
+			},
+		}, &hcmv3.HttpFilter{
+			Name: grpcWebFilterName,
+			ConfigType: &hcmv3.HttpFilter_TypedConfig{
+				TypedConfig: mustAny(&grpcwebv3.GrpcWeb{}),
+			},
+		})
+	}
+	if config.AuthEnabled {
 		httpFilters = append(httpFilters, &hcmv3.HttpFilter{
 			Name: "envoy.filters.http.ext_authz",
 			ConfigType: &hcmv3.HttpFilter_TypedConfig{
@@ -170,44 +282,43 @@ func makeSnapshot(hashToTask map[string]Task, version string, baseDomain string,
 		},
 	})
 
+	var tracing *hcmv3.HttpConnectionManager_Tracing
+	if config.OTLPEndpoint != "" {
+		collector, err := makeHostPortFromNode(config.OTLPEndpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OTLP endpoint %q: %v", config.OTLPEndpoint, err)
+		}
+		clusters = append(clusters, makeCluster(otlpClusterName, []HostPort{*collector}, true, true, serviceOptions{}))
+		tracing = makeTracing(config.TraceSamplingPercent)
+	}
+
+	routeConfig := &routev3.RouteConfiguration{
+		Name:         "local_routes",
+		VirtualHosts: vhosts,
+	}
+	tls := len(config.Certificates) > 0
+	if tls && config.HSTSMaxAge > 0 {
+		routeConfig.ResponseHeadersToAdd = []*corev3.HeaderValueOption{makeHSTSHeader(config)}
+	}
+
 	// HCM using RDS via ADS
 	hcm := &hcmv3.HttpConnectionManager{
 		StatPrefix: "ingress_http",
 		RouteSpecifier: &hcmv3.HttpConnectionManager_RouteConfig{
-			RouteConfig: &routev3.RouteConfiguration{
-				Name:         "local_routes",
-				VirtualHosts: vhosts,
-			},
+			RouteConfig: routeConfig,
 		},
+		Tracing:              tracing,
 		CodecType:            hcmv3.HttpConnectionManager_AUTO,
 		HttpFilters:          httpFilters,
 		Http2ProtocolOptions: &corev3.Http2ProtocolOptions{},
+		// websocket is disabled by default and enabled per route for services with 'websocket' option
+		UpgradeConfigs: []*hcmv3.HttpConnectionManager_UpgradeConfig{{
+			UpgradeType: websocketUpgrade,
+			Enabled:     &wrapperspb.BoolValue{Value: false},
+		}},
 	}
 
-	var transportSocket *corev3.TransportSocket
-	if tls {
-		transportSocket = &corev3.TransportSocket{
-			Name: "envoy.transport_sockets.tls",
-			ConfigType: &corev3.TransportSocket_TypedConfig{TypedConfig: mustAny(
-				&tlsv3.DownstreamTlsContext{
-					CommonTlsContext: &tlsv3.CommonTlsContext{
-						TlsCertificates: []*tlsv3.TlsCertificate{{
-							CertificateChain: &corev3.DataSource{
-								Specifier: &corev3.DataSource_Filename{
-									Filename: TLSCrtPath,
-								},
-							},
-							PrivateKey: &corev3.DataSource{
-								Specifier: &corev3.DataSource_Filename{
-									Filename: TLSKeyPath,
-								},
-							},
-						}},
-					},
-				},
-			)},
-		}
-	}
+	filterChains, listenerFilters, secrets := makeFilterChains(hcm, config)
 
 	listener := &listenerv3.Listener{
 		Name: "listener_0",
@@ -222,13 +333,8 @@ func makeSnapshot(hashToTask map[string]Task, version string, baseDomain string,
 				},
 			},
 		},
-		FilterChains: []*listenerv3.FilterChain{{
-			Filters: []*listenerv3.Filter{{
-				Name:       "envoy.filters.network.http_connection_manager",
-				ConfigType: &listenerv3.Filter_TypedConfig{TypedConfig: mustAny(hcm)},
-			}},
-			TransportSocket: transportSocket,
-		}},
+		ListenerFilters: listenerFilters,
+		FilterChains:    filterChains,
 		AccessLog: []*accesslog3.AccessLog{
 			{
 				Name: "envoy.access_loggers.stderr",
@@ -247,9 +353,31 @@ func makeSnapshot(hashToTask map[string]Task, version string, baseDomain string,
 		},
 	}
 
+	var listeners []cachetypes.Resource
+	if tls || !config.TLSRequired {
+		listeners = append(listeners, listener)
+	} else {
+		// tasks aren't served in plaintext until certificates are loaded
+		clusters = nil
+	}
+	// redirect listener serves ACME challenges before the first certificate is issued too
+	if config.HTTPRedirect {
+		var acmeChallengeCluster *clusterv3.Cluster
+		if config.ACMEChallengeEndpoint != "" {
+			solver, err := makeHostPortFromNode(config.ACMEChallengeEndpoint)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ACME challenge endpoint %q: %v", config.ACMEChallengeEndpoint, err)
+			}
+			acmeChallengeCluster = makeCluster(acmeChallengeClusterName, []HostPort{*solver}, false, true, serviceOptions{})
+			clusters = append(clusters, acmeChallengeCluster)
+		}
+		listeners = append(listeners, makeRedirectListener(acmeChallengeCluster != nil, tls))
+	}
+
 	snap, err := cachev3.NewSnapshot(version, map[resourcev3.Type][]cachetypes.Resource{
 		resourcev3.ClusterType:  clusters,
-		resourcev3.ListenerType: {listener},
+		resourcev3.ListenerType: listeners,
+		resourcev3.SecretType:   secrets,
 	})
 	if err != nil {
 		return nil, err
@@ -257,12 +385,201 @@ func makeSnapshot(hashToTask map[string]Task, version string, baseDomain string,
 	return snap, snap.Consistent()
 }
 
-func makeCluster(name string, host string, port uint32, grpc bool, resolveDomain bool) *clusterv3.Cluster {
+func makeHSTSHeader(config SnapshotConfig) *corev3.HeaderValueOption {
+	value := fmt.Sprintf("max-age=%d", int64(config.HSTSMaxAge.Seconds()))
+	if config.HSTSIncludeSubdomains {
+		value += "; includeSubDomains"
+	}
+	return &corev3.HeaderValueOption{
+		Header: &corev3.HeaderValue{Key: "Strict-Transport-Security", Value: value},
+		// services can set their own policy
+		AppendAction: corev3.HeaderValueOption_ADD_IF_ABSENT,
+	}
+}
+
+// Plaintext listener passing ACME HTTP-01 challenges to solver, so certificates can be issued for task domains,
+// and answering other requests with 301 to HTTPS once it's served, or with 404 until then
+func makeRedirectListener(acmeChallenge bool, redirect bool) *listenerv3.Listener {
+	var routes []*routev3.Route
+	if acmeChallenge {
+		routes = append(routes, &routev3.Route{
+			Match: &routev3.RouteMatch{PathSpecifier: &routev3.RouteMatch_Prefix{Prefix: acmeChallengePathPrefix}},
+			Action: &routev3.Route_Route{Route: &routev3.RouteAction{
+				ClusterSpecifier: &routev3.RouteAction_Cluster{Cluster: acmeChallengeClusterName},
+			}},
+		})
+	}
+	if redirect {
+		routes = append(routes, &routev3.Route{
+			Match: &routev3.RouteMatch{PathSpecifier: &routev3.RouteMatch_Prefix{Prefix: "/"}},
+			Action: &routev3.Route_Redirect{Redirect: &routev3.RedirectAction{
+				SchemeRewriteSpecifier: &routev3.RedirectAction_HttpsRedirect{HttpsRedirect: true},
+				ResponseCode:           routev3.RedirectAction_MOVED_PERMANENTLY,
+			}},
+		})
+	}
+
+	hcm := &hcmv3.HttpConnectionManager{
+		StatPrefix: "redirect_http",
+		RouteSpecifier: &hcmv3.HttpConnectionManager_RouteConfig{
+			RouteConfig: &routev3.RouteConfiguration{
+				Name: "redirect_routes",
+				VirtualHosts: []*routev3.VirtualHost{{
+					Name:    "vhost_redirect",
+					Domains: []string{"*"},
+					Routes:  routes,
+				}},
+			},
+		},
+		CodecType: hcmv3.HttpConnectionManager_AUTO,
+		HttpFilters: []*hcmv3.HttpFilter{{
+			Name: "envoy.filters.http.router",
+			ConfigType: &hcmv3.HttpFilter_TypedConfig{
+				TypedConfig: mustAny(&routerv3.Router{}),
+			},
+		}},
+	}
+
+	return &listenerv3.Listener{
+		Name: "listener_redirect",
+		Address: &corev3.Address{
+			Address: &corev3.Address_SocketAddress{
+				SocketAddress: &corev3.SocketAddress{
+					Protocol: corev3.SocketAddress_TCP,
+					Address:  "0.0.0.0",
+					PortSpecifier: &corev3.SocketAddress_PortValue{
+						PortValue: redirectProxyPort,
+					},
+				},
+			},
+		},
+		FilterChains: []*listenerv3.FilterChain{{
+			Filters: []*listenerv3.Filter{{
+				Name:       "envoy.filters.network.http_connection_manager",
+				ConfigType: &listenerv3.Filter_TypedConfig{TypedConfig: mustAny(hcm)},
+			}},
+		}},
+	}
+}
+
+func taskDomains(hash string, task Task, config SnapshotConfig) []string {
+	domains := []string{task.domain(hash, config.BaseDomain)}
+	for _, baseDomain := range config.AdditionalBaseDomains {
+		domains = append(domains, task.domain(hash, baseDomain))
+	}
+	return domains
+}
+
+// One plaintext filter chain without certificates; otherwise TLS filter chain per certificate domain,
+// selected by SNI, and default one for certificates without domain
+func makeFilterChains(
+	hcm *hcmv3.HttpConnectionManager,
+	config SnapshotConfig,
+) ([]*listenerv3.FilterChain, []*listenerv3.ListenerFilter, []cachetypes.Resource) {
+	certificates := config.Certificates
+	filters := []*listenerv3.Filter{{
+		Name:       "envoy.filters.network.http_connection_manager",
+		ConfigType: &listenerv3.Filter_TypedConfig{TypedConfig: mustAny(hcm)},
+	}}
+	if len(certificates) == 0 {
+		return []*listenerv3.FilterChain{{Filters: filters}}, nil, nil
+	}
+
+	var domains []string
+	domainSDSConfigs := make(map[string][]*tlsv3.SdsSecretConfig)
+	var secrets []cachetypes.Resource
+	for _, certificate := range certificates {
+		if _, ok := domainSDSConfigs[certificate.domain]; !ok {
+			domains = append(domains, certificate.domain)
+		}
+		// certificates are fetched over the same ADS stream, so renewed ones are applied without Envoy restart
+		domainSDSConfigs[certificate.domain] = append(domainSDSConfigs[certificate.domain], &tlsv3.SdsSecretConfig{
+			Name: certificate.secret.Name,
+			SdsConfig: &corev3.ConfigSource{
+				ConfigSourceSpecifier: &corev3.ConfigSource_Ads{Ads: &corev3.AggregatedConfigSource{}},
+				ResourceApiVersion:    corev3.ApiVersion_V3,
+			},
+		})
+		secrets = append(secrets, certificate.secret)
+	}
+
+	var filterChains []*listenerv3.FilterChain
+	var listenerFilters []*listenerv3.ListenerFilter
+	for _, domain := range domains {
+		filterChain := &listenerv3.FilterChain{
+			Filters: filters,
+			TransportSocket: &corev3.TransportSocket{
+				Name: "envoy.transport_sockets.tls",
+				ConfigType: &corev3.TransportSocket_TypedConfig{TypedConfig: mustAny(
+					makeDownstreamTLSContext(domainSDSConfigs[domain], config),
+				)},
+			},
+		}
+		if domain != "" {
+			filterChain.Name = "tls_" + domain
+			// wildcard matches subdomains of any depth, so cluster domains are matched too
+			filterChain.FilterChainMatch = &listenerv3.FilterChainMatch{ServerNames: []string{"*." + domain}}
+			// server name is matched before handshake, so it's read from ClientHello by TLS inspector
+			listenerFilters = []*listenerv3.ListenerFilter{{
+				Name: "envoy.filters.listener.tls_inspector",
+				ConfigType: &listenerv3.ListenerFilter_TypedConfig{
+					TypedConfig: mustAny(&tlsinspectorv3.TlsInspector{}),
+				},
+			}}
+		}
+		filterChains = append(filterChains, filterChain)
+	}
+	return filterChains, listenerFilters, secrets
+}
+
+func makeDownstreamTLSContext(sdsConfigs []*tlsv3.SdsSecretConfig, config SnapshotConfig) *tlsv3.DownstreamTlsContext {
+	tlsContext := &tlsv3.DownstreamTlsContext{
+		CommonTlsContext: &tlsv3.CommonTlsContext{
+			TlsCertificateSdsSecretConfigs: sdsConfigs,
+		},
+	}
+	if config.ClientCertificateMode == ClientCertificateNone {
+		return tlsContext
+	}
+	// with trusted CA Envoy asks for certificate, and rejects handshake with invalid one even if it's optional
+	tlsContext.CommonTlsContext.ValidationContextType = &tlsv3.CommonTlsContext_ValidationContext{
+		ValidationContext: &tlsv3.CertificateValidationContext{
+			TrustedCa: &corev3.DataSource{
+				Specifier: &corev3.DataSource_InlineBytes{InlineBytes: config.ClientCA},
+			},
+		},
+	}
+	tlsContext.RequireClientCertificate = wrapperspb.Bool(config.ClientCertificateMode == ClientCertificateRequire)
+	return tlsContext
+}
+
+func makeCluster(name string, endpoints []HostPort, grpc bool, resolveDomain bool, options serviceOptions) *clusterv3.Cluster {
 	discoveryType := clusterv3.Cluster_STATIC
 	if resolveDomain {
 		discoveryType = clusterv3.Cluster_STRICT_DNS
 	}
 
+	var lbEndpoints []*endpointv3.LbEndpoint
+	for _, endpoint := range endpoints {
+		lbEndpoints = append(lbEndpoints, &endpointv3.LbEndpoint{
+			HostIdentifier: &endpointv3.LbEndpoint_Endpoint{
+				Endpoint: &endpointv3.Endpoint{
+					Address: &corev3.Address{
+						Address: &corev3.Address_SocketAddress{
+							SocketAddress: &corev3.SocketAddress{
+								Protocol: corev3.SocketAddress_TCP,
+								Address:  endpoint.host,
+								PortSpecifier: &corev3.SocketAddress_PortValue{
+									PortValue: endpoint.port,
+								},
+							},
+						},
+					},
+				},
+			},
+		})
+	}
+
 	cluster := clusterv3.Cluster{
 		Name:                 name,
 		ConnectTimeout:       durationpb.New(2 * time.Second),
@@ -271,23 +588,7 @@ func makeCluster(name string, host string, port uint32, grpc bool, resolveDomain
 		LoadAssignment: &endpointv3.ClusterLoadAssignment{
 			ClusterName: name,
 			Endpoints: []*endpointv3.LocalityLbEndpoints{{
-				LbEndpoints: []*endpointv3.LbEndpoint{{
-					HostIdentifier: &endpointv3.LbEndpoint_Endpoint{
-						Endpoint: &endpointv3.Endpoint{
-							Address: &corev3.Address{
-								Address: &corev3.Address_SocketAddress{
-									SocketAddress: &corev3.SocketAddress{
-										Protocol: corev3.SocketAddress_TCP,
-										Address:  host,
-										PortSpecifier: &corev3.SocketAddress_PortValue{
-											PortValue: port,
-										},
-									},
-								},
-							},
-						},
-					},
-				}},
+				LbEndpoints: lbEndpoints,
 			}},
 		},
 	}
@@ -306,9 +607,156 @@ func makeCluster(name string, host string, port uint32, grpc bool, resolveDomain
 			),
 		}
 	}
+	if options.upstreamTLS.enabled {
+		cluster.TransportSocket = &corev3.TransportSocket{
+			Name: "envoy.transport_sockets.tls",
+			ConfigType: &corev3.TransportSocket_TypedConfig{
+				TypedConfig: mustAny(makeUpstreamTLSContext(options.upstreamTLS, grpc)),
+			},
+		}
+	}
+	switch {
+	case options.sticky.enabled && options.sticky.lbPolicy == maglevLbPolicy:
+		cluster.LbPolicy = clusterv3.Cluster_MAGLEV
+	case options.sticky.enabled:
+		cluster.LbPolicy = clusterv3.Cluster_RING_HASH
+	}
+	if options.healthCheck.enabled {
+		cluster.HealthChecks = []*corev3.HealthCheck{makeHealthCheck(options.healthCheck)}
+	}
 	return &cluster
 }
 
+func makeStickyHashPolicy(options stickyOptions, defaultCookieTTL time.Duration) *routev3.RouteAction_HashPolicy {
+	if options.header != "" {
+		return &routev3.RouteAction_HashPolicy{
+			PolicySpecifier: &routev3.RouteAction_HashPolicy_Header_{
+				Header: &routev3.RouteAction_HashPolicy_Header{HeaderName: options.header},
+			},
+		}
+	}
+	// Envoy generates cookie with TTL if request has none
+	return &routev3.RouteAction_HashPolicy{
+		PolicySpecifier: &routev3.RouteAction_HashPolicy_Cookie_{
+			Cookie: &routev3.RouteAction_HashPolicy_Cookie{
+				Name: options.cookieName,
+				Ttl:  durationpb.New(options.cookieTTL.getOr(defaultCookieTTL)),
+				Path: "/",
+			},
+		},
+	}
+}
+
+func makeHealthCheck(options healthCheckOptions) *corev3.HealthCheck {
+	healthCheck := &corev3.HealthCheck{
+		Timeout:            durationpb.New(options.timeout),
+		Interval:           durationpb.New(options.interval),
+		HealthyThreshold:   &wrapperspb.UInt32Value{Value: options.healthyThreshold},
+		UnhealthyThreshold: &wrapperspb.UInt32Value{Value: options.unhealthyThreshold},
+	}
+	switch options.kind {
+	case grpcHealthCheck:
+		healthCheck.HealthChecker = &corev3.HealthCheck_GrpcHealthCheck_{
+			GrpcHealthCheck: &corev3.HealthCheck_GrpcHealthCheck{
+				ServiceName: options.serviceName,
+			},
+		}
+	case tcpHealthCheck:
+		// empty payloads, only connection is checked
+		healthCheck.HealthChecker = &corev3.HealthCheck_TcpHealthCheck_{
+			TcpHealthCheck: &corev3.HealthCheck_TcpHealthCheck{},
+		}
+	default:
+		healthCheck.HealthChecker = &corev3.HealthCheck_HttpHealthCheck_{
+			HttpHealthCheck: &corev3.HealthCheck_HttpHealthCheck{
+				Path: options.path,
+			},
+		}
+	}
+	return healthCheck
+}
+
+func makeUpstreamTLSContext(options upstreamTLSOptions, grpc bool) *tlsv3.UpstreamTlsContext {
+	tlsContext := &tlsv3.UpstreamTlsContext{
+		Sni:              options.sni,
+		CommonTlsContext: &tlsv3.CommonTlsContext{},
+	}
+	if grpc {
+		tlsContext.CommonTlsContext.AlpnProtocols = []string{"h2"}
+	}
+	if options.skipVerify {
+		// without validation context Envoy accepts any certificate, e.g. self-signed one
+		return tlsContext
+	}
+
+	validationContext := &tlsv3.CertificateValidationContext{
+		TrustedCa: &corev3.DataSource{
+			Specifier: &corev3.DataSource_Filename{Filename: systemCABundlePath},
+		},
+	}
+	if options.ca != "" {
+		validationContext.TrustedCa.Specifier = &corev3.DataSource_InlineString{InlineString: options.ca}
+	}
+	if options.sni != "" {
+		validationContext.MatchTypedSubjectAltNames = []*tlsv3.SubjectAltNameMatcher{{
+			SanType: tlsv3.SubjectAltNameMatcher_DNS,
+			Matcher: &matcherv3.StringMatcher{
+				MatchPattern: &matcherv3.StringMatcher_Exact{Exact: options.sni},
+			},
+		}}
+	}
+	tlsContext.CommonTlsContext.ValidationContextType = &tlsv3.CommonTlsContext_ValidationContext{
+		ValidationContext: validationContext,
+	}
+	return tlsContext
+}
+
+// Envoy sends spans to OTLP collector and propagates trace context to ext_authz and services
+func makeTracing(samplingPercent float64) *hcmv3.HttpConnectionManager_Tracing {
+	return &hcmv3.HttpConnectionManager_Tracing{
+		RandomSampling: &typev3.Percent{Value: samplingPercent},
+		Provider: &tracev3.Tracing_Http{
+			Name: "envoy.tracers.opentelemetry",
+			ConfigType: &tracev3.Tracing_Http_TypedConfig{
+				TypedConfig: mustAny(&tracev3.OpenTelemetryConfig{
+					GrpcService: &corev3.GrpcService{
+						TargetSpecifier: &corev3.GrpcService_EnvoyGrpc_{
+							EnvoyGrpc: &corev3.GrpcService_EnvoyGrpc{
+								ClusterName: otlpClusterName,
+							},
+						},
+						Timeout: durationpb.New(250 * time.Millisecond),
+					},
+					ServiceName: "task-proxy",
+				}),
+			},
+		},
+	}
+}
+
+func makeGRPCWebCorsPolicy(allowedOrigins []string) *corsv3.CorsPolicy {
+	policy := &corsv3.CorsPolicy{
+		AllowMethods:  "GET, PUT, DELETE, POST, OPTIONS",
+		AllowHeaders:  "authorization, keep-alive, user-agent, cache-control, content-type, content-transfer-encoding, x-accept-content-transfer-encoding, x-accept-response-streaming, x-user-agent, x-grpc-web, grpc-timeout",
+		ExposeHeaders: "grpc-status, grpc-message",
+		MaxAge:        "1728000",
+	}
+	if len(allowedOrigins) == 0 {
+		policy.AllowOriginStringMatch = []*matcherv3.StringMatcher{{
+			MatchPattern: &matcherv3.StringMatcher_SafeRegex{SafeRegex: &matcherv3.RegexMatcher{Regex: ".*"}},
+		}}
+		policy.AllowCredentials = &wrapperspb.BoolValue{Value: false}
+		return policy
+	}
+	for _, origin := range allowedOrigins {
+		policy.AllowOriginStringMatch = append(policy.AllowOriginStringMatch, &matcherv3.StringMatcher{
+			MatchPattern: &matcherv3.StringMatcher_Exact{Exact: origin},
+		})
+	}
+	policy.AllowCredentials = &wrapperspb.BoolValue{Value: true}
+	return policy
+}
+
 func mustAny(m proto.Message) *anypb.Any {
 	a, err := anypb.New(m)
 	if err != nil {
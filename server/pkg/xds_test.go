@@ -0,0 +1,474 @@
+package pkg
+
+import (
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	listenerv3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	corsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/cors/v3"
+	extauthzv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_authz/v3"
+	hcmv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	resourcev3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testSnapshotConfig = SnapshotConfig{
+	BaseDomain:   "example.net",
+	AuthEnabled:  true,
+	RouteTimeout: 15 * time.Second,
+	NumRetries:   1,
+}
+
+func getSnapshotHCM(t *testing.T, hashToTask map[string]Task, config SnapshotConfig) *hcmv3.HttpConnectionManager {
+	snapshot, err := makeSnapshot(hashToTask, "1", config)
+	require.NoError(t, err)
+
+	listeners := snapshot.GetResources(resourcev3.ListenerType)
+	require.Len(t, listeners, 1)
+	listener := listeners["listener_0"].(*listenerv3.Listener)
+
+	hcm := &hcmv3.HttpConnectionManager{}
+	require.NoError(t, listener.FilterChains[0].Filters[0].GetTypedConfig().UnmarshalTo(hcm))
+	return hcm
+}
+
+func getVirtualHost(t *testing.T, hcm *hcmv3.HttpConnectionManager, name string) *routev3.VirtualHost {
+	for _, vhost := range hcm.GetRouteConfig().VirtualHosts {
+		if vhost.Name == name {
+			return vhost
+		}
+	}
+	require.FailNow(t, "no virtual host", name)
+	return nil
+}
+
+func TestMakeSnapshotWebsocket(t *testing.T) {
+	hcm := getSnapshotHCM(t, map[string]Task{
+		"00000001": {
+			operationID: "op1",
+			taskName:    "jupyter",
+			service:     "lab",
+			protocol:    HTTP,
+			jobs:        []HostPort{{host: "node1", port: 8888}},
+			options:     serviceOptions{websocket: true},
+		},
+		"00000002": {
+			operationID: "op2",
+			taskName:    "driver",
+			service:     "ui",
+			protocol:    HTTP,
+			jobs:        []HostPort{{host: "node2", port: 4040}},
+		},
+	}, testSnapshotConfig)
+
+	require.Len(t, hcm.UpgradeConfigs, 1)
+	assert.Equal(t, websocketUpgrade, hcm.UpgradeConfigs[0].UpgradeType)
+	assert.False(t, hcm.UpgradeConfigs[0].Enabled.GetValue())
+
+	upgradeConfigs := getVirtualHost(t, hcm, "op1-jupyter-lab").Routes[0].GetRoute().UpgradeConfigs
+	require.Len(t, upgradeConfigs, 1)
+	assert.Equal(t, websocketUpgrade, upgradeConfigs[0].UpgradeType)
+	assert.True(t, upgradeConfigs[0].Enabled.GetValue())
+
+	assert.Empty(t, getVirtualHost(t, hcm, "op2-driver-ui").Routes[0].GetRoute().UpgradeConfigs)
+}
+
+func TestMakeSnapshotGRPCWeb(t *testing.T) {
+	hashToTask := map[string]Task{
+		"00000001": {
+			operationID: "op1",
+			taskName:    "example_grpc_server",
+			service:     "server",
+			protocol:    GRPC,
+			jobs:        []HostPort{{host: "node1", port: 50051}},
+			options:     serviceOptions{grpcWeb: true},
+		},
+		"00000002": {
+			operationID: "op2",
+			taskName:    "driver",
+			service:     "ui",
+			protocol:    HTTP,
+			jobs:        []HostPort{{host: "node2", port: 4040}},
+		},
+	}
+
+	config := testSnapshotConfig
+	config.GRPCWebAllowedOrigins = []string{"https://dashboard.example.net"}
+	hcm := getSnapshotHCM(t, hashToTask, config)
+
+	var filterNames []string
+	for _, filter := range hcm.HttpFilters {
+		filterNames = append(filterNames, filter.Name)
+	}
+	assert.Equal(t, []string{
+		corsFilterName,
+		grpcWebFilterName,
+		"envoy.filters.http.ext_authz",
+		"envoy.filters.http.router",
+	}, filterNames)
+
+	grpcWebRoute := getVirtualHost(t, hcm, "op1-example_grpc_server-server").Routes[0]
+	policy := &corsv3.CorsPolicy{}
+	require.NoError(t, grpcWebRoute.TypedPerFilterConfig[corsFilterName].UnmarshalTo(policy))
+	assert.Equal(t, "https://dashboard.example.net", policy.AllowOriginStringMatch[0].GetExact())
+	assert.True(t, policy.AllowCredentials.GetValue())
+
+	httpRoute := getVirtualHost(t, hcm, "op2-driver-ui").Routes[0]
+	filterConfig := &routev3.FilterConfig{}
+	require.NoError(t, httpRoute.TypedPerFilterConfig[grpcWebFilterName].UnmarshalTo(filterConfig))
+	assert.True(t, filterConfig.Disabled)
+
+	delete(hashToTask, "00000001")
+	hcm = getSnapshotHCM(t, hashToTask, testSnapshotConfig)
+	assert.Len(t, hcm.HttpFilters, 2)
+	assert.Empty(t, getVirtualHost(t, hcm, "op2-driver-ui").Routes[0].TypedPerFilterConfig)
+}
+
+func TestMakeClusterUpstreamTLS(t *testing.T) {
+	cluster := makeCluster("plain", []HostPort{{host: "node1", port: 8888}}, false, true, serviceOptions{})
+	assert.Nil(t, cluster.TransportSocket)
+	ca, _ := generateTestCertificate(t, "jupyter.local")
+
+	for _, tt := range []struct {
+		name       string
+		options    upstreamTLSOptions
+		grpc       bool
+		expectedCA string
+		inlineCA   string
+	}{
+		{
+			name:       "system CA",
+			options:    upstreamTLSOptions{enabled: true},
+			expectedCA: systemCABundlePath,
+		},
+		{
+			name:       "SNI for gRPC",
+			options:    upstreamTLSOptions{enabled: true, sni: "model.local"},
+			grpc:       true,
+			expectedCA: systemCABundlePath,
+		},
+		{
+			name:     "inline CA",
+			options:  upstreamTLSOptions{enabled: true, sni: "jupyter.local", ca: string(ca)},
+			inlineCA: string(ca),
+		},
+		{
+			name:    "skip verify",
+			options: upstreamTLSOptions{enabled: true, skipVerify: true, ca: string(ca)},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := makeCluster("tls", []HostPort{{host: "node1", port: 8888}}, tt.grpc, true, serviceOptions{upstreamTLS: tt.options})
+			require.NotNil(t, cluster.TransportSocket)
+
+			tlsContext := &tlsv3.UpstreamTlsContext{}
+			require.NoError(t, cluster.TransportSocket.GetTypedConfig().UnmarshalTo(tlsContext))
+			assert.Equal(t, tt.options.sni, tlsContext.Sni)
+			if tt.grpc {
+				assert.Equal(t, []string{"h2"}, tlsContext.CommonTlsContext.AlpnProtocols)
+			}
+
+			validationContext := tlsContext.CommonTlsContext.GetValidationContext()
+			if tt.expectedCA == "" && tt.inlineCA == "" {
+				assert.Nil(t, validationContext)
+				return
+			}
+			assert.Equal(t, tt.expectedCA, validationContext.TrustedCa.GetFilename())
+			assert.Equal(t, tt.inlineCA, validationContext.TrustedCa.GetInlineString())
+			if tt.options.sni != "" {
+				assert.Equal(t, tt.options.sni, validationContext.MatchTypedSubjectAltNames[0].Matcher.GetExact())
+			}
+		})
+	}
+}
+
+func TestMakeSnapshotHealthCheck(t *testing.T) {
+	snapshot, err := makeSnapshot(map[string]Task{
+		"00000001": {
+			operationID: "op1",
+			taskName:    "example_grpc_server",
+			service:     "server",
+			protocol:    GRPC,
+			jobs:        []HostPort{{host: "node1", port: 50051}, {host: "node2", port: 50051}},
+			options: serviceOptions{healthCheck: healthCheckOptions{
+				enabled:            true,
+				kind:               grpcHealthCheck,
+				serviceName:        "helloworld.Greeter",
+				interval:           5 * time.Second,
+				timeout:            time.Second,
+				healthyThreshold:   1,
+				unhealthyThreshold: 2,
+			}},
+		},
+	}, "1", testSnapshotConfig)
+	require.NoError(t, err)
+
+	cluster := snapshot.GetResources(resourcev3.ClusterType)["op1-example_grpc_server-server"].(*clusterv3.Cluster)
+	assert.Len(t, cluster.LoadAssignment.Endpoints[0].LbEndpoints, 2)
+	assert.NotNil(t, cluster.OutlierDetection)
+	require.Len(t, cluster.HealthChecks, 1)
+	assert.Equal(t, "helloworld.Greeter", cluster.HealthChecks[0].GetGrpcHealthCheck().ServiceName)
+	assert.Equal(t, 5*time.Second, cluster.HealthChecks[0].Interval.AsDuration())
+	assert.Equal(t, uint32(2), cluster.HealthChecks[0].UnhealthyThreshold.GetValue())
+
+	authzCluster := snapshot.GetResources(resourcev3.ClusterType)[extAuthClusterName].(*clusterv3.Cluster)
+	assert.Nil(t, authzCluster.OutlierDetection)
+	assert.Empty(t, authzCluster.HealthChecks)
+}
+
+func TestMakeSnapshotRouteTimeoutsAndRetries(t *testing.T) {
+	config := testSnapshotConfig
+	config.RetryOn = "connect-failure"
+
+	hcm := getSnapshotHCM(t, map[string]Task{
+		"00000001": {
+			operationID: "op1",
+			taskName:    "model",
+			service:     "inference",
+			protocol:    HTTP,
+			jobs:        []HostPort{{host: "node1", port: 8000}},
+			options: serviceOptions{
+				timeout:     optionalOf(time.Duration(0)),
+				idleTimeout: optionalOf(10 * time.Minute),
+				retryOn:     optionalOf("5xx,reset"),
+				numRetries:  optionalOf(uint32(3)),
+			},
+		},
+		"00000002": {
+			operationID: "op2",
+			taskName:    "driver",
+			service:     "ui",
+			protocol:    HTTP,
+			jobs:        []HostPort{{host: "node2", port: 4040}},
+		},
+	}, config)
+
+	action := getVirtualHost(t, hcm, "op1-model-inference").Routes[0].GetRoute()
+	assert.Equal(t, time.Duration(0), action.Timeout.AsDuration())
+	assert.Equal(t, 10*time.Minute, action.IdleTimeout.AsDuration())
+	assert.Equal(t, "5xx,reset", action.RetryPolicy.RetryOn)
+	assert.Equal(t, uint32(3), action.RetryPolicy.NumRetries.GetValue())
+
+	action = getVirtualHost(t, hcm, "op2-driver-ui").Routes[0].GetRoute()
+	assert.Equal(t, 15*time.Second, action.Timeout.AsDuration())
+	assert.Nil(t, action.IdleTimeout)
+	assert.Equal(t, "connect-failure", action.RetryPolicy.RetryOn)
+	assert.Equal(t, uint32(1), action.RetryPolicy.NumRetries.GetValue())
+}
+
+func TestMakeSnapshotSticky(t *testing.T) {
+	config := testSnapshotConfig
+	config.StickyCookieTTL = time.Hour
+
+	jobs := []HostPort{{host: "node1", port: 8888}, {host: "node2", port: 8888}}
+	snapshot, err := makeSnapshot(map[string]Task{
+		"00000001": {
+			operationID: "op1",
+			taskName:    "gradio",
+			service:     "ui",
+			protocol:    HTTP,
+			jobs:        jobs,
+			options:     serviceOptions{sticky: stickyOptions{enabled: true, lbPolicy: ringHashLbPolicy, cookieName: "affinity"}},
+		},
+		"00000002": {
+			operationID: "op2",
+			taskName:    "master",
+			service:     "ui",
+			protocol:    HTTP,
+			jobs:        jobs,
+			options:     serviceOptions{sticky: stickyOptions{enabled: true, lbPolicy: maglevLbPolicy, header: "x-session-id"}},
+		},
+	}, "1", config)
+	require.NoError(t, err)
+
+	clusters := snapshot.GetResources(resourcev3.ClusterType)
+	assert.Equal(t, clusterv3.Cluster_RING_HASH, clusters["op1-gradio-ui"].(*clusterv3.Cluster).LbPolicy)
+	assert.Equal(t, clusterv3.Cluster_MAGLEV, clusters["op2-master-ui"].(*clusterv3.Cluster).LbPolicy)
+
+	listener := snapshot.GetResources(resourcev3.ListenerType)["listener_0"].(*listenerv3.Listener)
+	hcm := &hcmv3.HttpConnectionManager{}
+	require.NoError(t, listener.FilterChains[0].Filters[0].GetTypedConfig().UnmarshalTo(hcm))
+
+	cookie := getVirtualHost(t, hcm, "op1-gradio-ui").Routes[0].GetRoute().HashPolicy[0].GetCookie()
+	assert.Equal(t, "affinity", cookie.Name)
+	assert.Equal(t, time.Hour, cookie.Ttl.AsDuration())
+
+	header := getVirtualHost(t, hcm, "op2-master-ui").Routes[0].GetRoute().HashPolicy[0].GetHeader()
+	assert.Equal(t, "x-session-id", header.HeaderName)
+}
+
+func TestMakeSnapshotTracing(t *testing.T) {
+	hcm := getSnapshotHCM(t, map[string]Task{}, testSnapshotConfig)
+	assert.Nil(t, hcm.Tracing)
+
+	config := testSnapshotConfig
+	config.OTLPEndpoint = "otel-collector.monitoring:4317"
+	config.TraceSamplingPercent = 10
+
+	snapshot, err := makeSnapshot(map[string]Task{}, "1", config)
+	require.NoError(t, err)
+	assert.Contains(t, snapshot.GetResources(resourcev3.ClusterType), otlpClusterName)
+
+	hcm = getSnapshotHCM(t, map[string]Task{}, config)
+	require.NotNil(t, hcm.Tracing)
+	assert.Equal(t, 10.0, hcm.Tracing.RandomSampling.Value)
+	assert.Equal(t, "envoy.tracers.opentelemetry", hcm.Tracing.Provider.Name)
+
+	config.OTLPEndpoint = "otel-collector"
+	_, err = makeSnapshot(map[string]Task{}, "1", config)
+	assert.Error(t, err)
+}
+
+func TestMakeSnapshotSNI(t *testing.T) {
+	config := testSnapshotConfig
+	config.AdditionalBaseDomains = []string{"legacy.example.org"}
+	config.Certificates = []serverCertificate{
+		{domain: "example.net", secret: &tlsv3.Secret{Name: "server_cert_0"}},
+		{domain: "legacy.example.org", secret: &tlsv3.Secret{Name: "server_cert_1"}},
+		{secret: &tlsv3.Secret{Name: "server_cert_2"}},
+	}
+	hashToTask := map[string]Task{
+		"00000001": {operationID: "op1", taskName: "driver", service: "ui", protocol: HTTP},
+		"00000002": {cluster: "hahn", operationID: "op2", taskName: "driver", service: "ui", protocol: HTTP},
+	}
+
+	snapshot, err := makeSnapshot(hashToTask, "1", config)
+	require.NoError(t, err)
+	assert.Len(t, snapshot.GetResources(resourcev3.SecretType), 3)
+
+	listener := snapshot.GetResources(resourcev3.ListenerType)["listener_0"].(*listenerv3.Listener)
+	require.Len(t, listener.ListenerFilters, 1)
+	assert.Equal(t, "envoy.filters.listener.tls_inspector", listener.ListenerFilters[0].Name)
+	require.Len(t, listener.FilterChains, 3)
+	var serverNames [][]string
+	var secretNames []string
+	for _, filterChain := range listener.FilterChains {
+		serverNames = append(serverNames, filterChain.GetFilterChainMatch().GetServerNames())
+		var tlsContext tlsv3.DownstreamTlsContext
+		require.NoError(t, filterChain.TransportSocket.GetTypedConfig().UnmarshalTo(&tlsContext))
+		require.Len(t, tlsContext.CommonTlsContext.TlsCertificateSdsSecretConfigs, 1)
+		secretNames = append(secretNames, tlsContext.CommonTlsContext.TlsCertificateSdsSecretConfigs[0].Name)
+	}
+	assert.Equal(t, [][]string{{"*.example.net"}, {"*.legacy.example.org"}, nil}, serverNames)
+	assert.Equal(t, []string{"server_cert_0", "server_cert_1", "server_cert_2"}, secretNames)
+
+	hcm := getSnapshotHCM(t, hashToTask, config)
+	assert.Equal(
+		t,
+		[]string{"00000001.example.net", "00000001.legacy.example.org"},
+		getVirtualHost(t, hcm, "op1-driver-ui").Domains,
+	)
+	assert.Equal(
+		t,
+		[]string{"00000002.hahn.example.net", "00000002.hahn.legacy.example.org"},
+		getVirtualHost(t, hcm, "hahn-op2-driver-ui").Domains,
+	)
+
+	// the only certificate without domain doesn't need server name
+	config.Certificates = config.Certificates[2:]
+	snapshot, err = makeSnapshot(hashToTask, "1", config)
+	require.NoError(t, err)
+	listener = snapshot.GetResources(resourcev3.ListenerType)["listener_0"].(*listenerv3.Listener)
+	assert.Empty(t, listener.ListenerFilters)
+}
+
+func TestMakeSnapshotHTTPRedirect(t *testing.T) {
+	hashToTask := map[string]Task{
+		"00000001": {operationID: "op1", taskName: "driver", service: "ui", protocol: HTTP},
+	}
+	config := testSnapshotConfig
+	config.HTTPRedirect = true
+	config.ACMEChallengeEndpoint = "cm-acme-http-solver:8089"
+	config.HSTSMaxAge = 365 * 24 * time.Hour
+	config.HSTSIncludeSubdomains = true
+
+	// before the first certificate challenges are served, but nothing is redirected
+	config.TLSRequired = true
+	snapshot, err := makeSnapshot(hashToTask, "1", config)
+	require.NoError(t, err)
+	listeners := snapshot.GetResources(resourcev3.ListenerType)
+	require.Len(t, listeners, 1)
+	assert.Equal(t, []string{acmeChallengeClusterName}, slices.Collect(maps.Keys(snapshot.GetResources(resourcev3.ClusterType))))
+	redirectHCM := &hcmv3.HttpConnectionManager{}
+	redirectListener := listeners["listener_redirect"].(*listenerv3.Listener)
+	require.NoError(t, redirectListener.FilterChains[0].Filters[0].GetTypedConfig().UnmarshalTo(redirectHCM))
+	routes := redirectHCM.GetRouteConfig().VirtualHosts[0].Routes
+	require.Len(t, routes, 1)
+	assert.Equal(t, acmeChallengePathPrefix, routes[0].Match.GetPrefix())
+
+	config.Certificates = []serverCertificate{{secret: &tlsv3.Secret{Name: "server_cert_0"}}}
+	snapshot, err = makeSnapshot(hashToTask, "1", config)
+	require.NoError(t, err)
+	listeners = snapshot.GetResources(resourcev3.ListenerType)
+	require.Len(t, listeners, 2)
+	assert.Contains(t, snapshot.GetResources(resourcev3.ClusterType), acmeChallengeClusterName)
+
+	hcm := &hcmv3.HttpConnectionManager{}
+	listener := listeners["listener_0"].(*listenerv3.Listener)
+	require.NoError(t, listener.FilterChains[0].Filters[0].GetTypedConfig().UnmarshalTo(hcm))
+	headers := hcm.GetRouteConfig().ResponseHeadersToAdd
+	require.Len(t, headers, 1)
+	assert.Equal(t, "Strict-Transport-Security", headers[0].Header.Key)
+	assert.Equal(t, "max-age=31536000; includeSubDomains", headers[0].Header.Value)
+
+	redirectHCM = &hcmv3.HttpConnectionManager{}
+	redirectListener = listeners["listener_redirect"].(*listenerv3.Listener)
+	assert.Nil(t, redirectListener.FilterChains[0].TransportSocket)
+	require.NoError(t, redirectListener.FilterChains[0].Filters[0].GetTypedConfig().UnmarshalTo(redirectHCM))
+	routes = redirectHCM.GetRouteConfig().VirtualHosts[0].Routes
+	require.Len(t, routes, 2)
+	assert.Equal(t, acmeChallengePathPrefix, routes[0].Match.GetPrefix())
+	assert.Equal(t, acmeChallengeClusterName, routes[0].GetRoute().GetCluster())
+	assert.True(t, routes[1].GetRedirect().GetHttpsRedirect())
+	assert.Equal(t, routev3.RedirectAction_MOVED_PERMANENTLY, routes[1].GetRedirect().ResponseCode)
+
+	config.ACMEChallengeEndpoint = "solver"
+	_, err = makeSnapshot(hashToTask, "1", config)
+	assert.ErrorContains(t, err, "invalid ACME challenge endpoint")
+}
+
+func TestMakeSnapshotClientCertificates(t *testing.T) {
+	hashToTask := map[string]Task{
+		"00000001": {operationID: "op1", taskName: "driver", service: "ui", protocol: HTTP},
+	}
+	config := testSnapshotConfig
+	config.Certificates = []serverCertificate{{secret: &tlsv3.Secret{Name: "server_cert_0"}}}
+
+	for _, tt := range []struct {
+		mode            ClientCertificateMode
+		expectedRequire bool
+	}{
+		{mode: ClientCertificateNone},
+		{mode: ClientCertificateAccept},
+		{mode: ClientCertificateRequire, expectedRequire: true},
+	} {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			config.ClientCertificateMode = tt.mode
+			config.ClientCA = []byte("client CA")
+			hcm := getSnapshotHCM(t, hashToTask, config)
+
+			var authz extauthzv3.ExtAuthz
+			require.NoError(t, hcm.HttpFilters[0].GetTypedConfig().UnmarshalTo(&authz))
+			assert.Equal(t, tt.mode != ClientCertificateNone, authz.IncludePeerCertificate)
+
+			snapshot, err := makeSnapshot(hashToTask, "1", config)
+			require.NoError(t, err)
+			listener := snapshot.GetResources(resourcev3.ListenerType)["listener_0"].(*listenerv3.Listener)
+			var tlsContext tlsv3.DownstreamTlsContext
+			require.NoError(t, listener.FilterChains[0].TransportSocket.GetTypedConfig().UnmarshalTo(&tlsContext))
+			if tt.mode == ClientCertificateNone {
+				assert.Nil(t, tlsContext.RequireClientCertificate)
+				assert.Nil(t, tlsContext.CommonTlsContext.GetValidationContext())
+				return
+			}
+			assert.Equal(t, tt.expectedRequire, tlsContext.RequireClientCertificate.GetValue())
+			assert.Equal(t, config.ClientCA, tlsContext.CommonTlsContext.GetValidationContext().GetTrustedCa().GetInlineBytes())
+		})
+	}
+}